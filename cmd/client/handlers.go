@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"time"
@@ -8,31 +9,44 @@ import (
 	"github.com/nguyenanhhao221/learn-pub-sub-starter/internal/gamelogic"
 	"github.com/nguyenanhhao221/learn-pub-sub-starter/internal/pubsub"
 	"github.com/nguyenanhhao221/learn-pub-sub-starter/internal/routing"
-	amqp "github.com/rabbitmq/amqp091-go"
 )
 
-func handlerPause(gs *gamelogic.GameState) func(routing.PlayingState) pubsub.AckType {
-	return func(ps routing.PlayingState) pubsub.AckType {
+func handlerPause(gs *gamelogic.GameState, gate *pubsub.Gate) func(context.Context, routing.PlayingState) pubsub.AckType {
+	return func(_ context.Context, ps routing.PlayingState) pubsub.AckType {
 		defer fmt.Printf("> ")
 		gs.HandlePause(ps)
+		if ps.IsPaused {
+			gate.Pause()
+		} else {
+			gate.Resume()
+		}
 		return pubsub.Ack
 	}
 }
 
-func handlerMove(gs *gamelogic.GameState, publishCh *amqp.Channel) func(gamelogic.ArmyMove) pubsub.AckType {
-	return func(move gamelogic.ArmyMove) pubsub.AckType {
+func handlerMove(gs *gamelogic.GameState, publishCh pubsub.Publisher) func(context.Context, gamelogic.ArmyMove, pubsub.Metadata) pubsub.AckType {
+	return func(ctx context.Context, move gamelogic.ArmyMove, meta pubsub.Metadata) pubsub.AckType {
 		defer fmt.Printf("> ")
+		// A move is only trusted for the player whose key it was published under
+		if key, ok := meta.Key.(routing.ArmyMoveKey); !ok || key.Username != move.Player.Username {
+			log.Printf("discarding move by %s published under key %q", move.Player.Username, meta.RoutingKey)
+			return pubsub.NackDiscard
+		}
 		moveOutCome := gs.HandleMove(move)
 		switch moveOutCome {
 		case gamelogic.MoveOutComeSafe:
 			return pubsub.Ack
 		case gamelogic.MoveOutcomeMakeWar:
-			err := pubsub.PublishJSON(publishCh, routing.ExchangePerilTopic, routing.WarRecognitionsPrefix+"."+gs.Player.Username, gamelogic.RecognitionOfWar{
+			err := pubsub.PublishJSON(ctx, publishCh, routing.ExchangePerilTopic, routing.WarKey{Username: gs.GetUsername()}.String(), gamelogic.RecognitionOfWar{
 				Attacker: move.Player,
 				Defender: gs.GetPlayerSnap(),
-			})
+			},
+				pubsub.WithDerivedMessageID(ctx, "war."+gs.GetUsername()),
+				// Bigger wars are fought first when the war queue backs up
+				pubsub.WithPriority(uint8(min(len(move.Units), routing.WarMaxPriority))),
+			)
 			if err != nil {
-				log.Printf("fail to publish json for handlerMove to %s\n", routing.WarRecognitionsPrefix)
+				log.Printf("fail to publish json for handlerMove to %s: %v\n", routing.WarRecognitionsPrefix, err)
 				return pubsub.NackRequeue
 			}
 			return pubsub.Ack
@@ -45,55 +59,52 @@ func handlerMove(gs *gamelogic.GameState, publishCh *amqp.Channel) func(gamelogi
 	}
 }
 
-func handlerWar(gs *gamelogic.GameState, publishCh *amqp.Channel) func(dw gamelogic.RecognitionOfWar) pubsub.AckType {
-	return func(dw gamelogic.RecognitionOfWar) pubsub.AckType {
+func handlerWar(gs *gamelogic.GameState, outbox *pubsub.Outbox) func(ctx context.Context, dw gamelogic.RecognitionOfWar) pubsub.AckType {
+	return func(ctx context.Context, dw gamelogic.RecognitionOfWar) pubsub.AckType {
 		defer fmt.Print("> ")
 		// Handling war outcome
 		warOutcome, winner, loser := gs.HandleWar(dw)
+		var message string
 		switch warOutcome {
 		case gamelogic.WarOutcomeNotInvolved:
 			return pubsub.NackRequeue
 		case gamelogic.WarOutcomeNoUnits:
 			return pubsub.NackDiscard
-		case gamelogic.WarOutcomeOpponentWon:
-			msg := routing.GameLog{
-				CurrentTime: time.Now(),
-				Message:     fmt.Sprintf("%s won a war against %s", winner, loser),
-				Username:    gs.Player.Username,
-			}
-			err := pubsub.PublishGob(publishCh, string(routing.ExchangePerilTopic), routing.GameLogSlug+"."+dw.Attacker.Username, msg)
-			if err != nil {
-				fmt.Printf("error: %s\n", err)
-				return pubsub.NackRequeue
-			}
-			return pubsub.Ack
-		case gamelogic.WarOutcomeYouWon:
-			msg := routing.GameLog{
-				CurrentTime: time.Now(),
-				Message:     fmt.Sprintf("%s won a war against %s", winner, loser),
-				Username:    gs.Player.Username,
-			}
-			err := pubsub.PublishGob(publishCh, string(routing.ExchangePerilTopic), routing.GameLogSlug+"."+dw.Attacker.Username, msg)
-			if err != nil {
-				fmt.Printf("error: %s\n", err)
-				return pubsub.NackRequeue
-			}
-			return pubsub.Ack
+		case gamelogic.WarOutcomeOpponentWon, gamelogic.WarOutcomeYouWon:
+			message = fmt.Sprintf("%s won a war against %s", winner, loser)
 		case gamelogic.WarOutcomeDraw:
-			msg := routing.GameLog{
-				CurrentTime: time.Now(),
-				Message:     fmt.Sprintf("A war between %s and %s resulted in a draw", winner, loser),
-				Username:    gs.Player.Username,
+			message = fmt.Sprintf("A war between %s and %s resulted in a draw", winner, loser)
+		default:
+			fmt.Println("error: unknown war outcome")
+			return pubsub.NackDiscard
+		}
+
+		// Save the units lost, the game log and the fact that this war was
+		// handled together, so neither a failed publish nor a restart makes a
+		// redelivery kill units twice. The log is relayed from the outbox.
+		err := outbox.Update(func(tx *pubsub.OutboxTx) error {
+			if err := savePlayer(tx, gs.GetPlayerSnap()); err != nil {
+				return err
 			}
-			err := pubsub.PublishGob(publishCh, string(routing.ExchangePerilTopic), routing.GameLogSlug+"."+dw.Attacker.Username, msg)
-			if err != nil {
-				fmt.Printf("error: %s\n", err)
-				return pubsub.NackRequeue
+			if meta, ok := pubsub.MetadataFromContext(ctx); ok && meta.MessageID != "" {
+				if err := tx.MarkHandled(meta.MessageID, time.Now().Add(warDedupeTTL)); err != nil {
+					return err
+				}
 			}
-			return pubsub.Ack
+			return pubsub.Enqueue(tx, routing.ExchangePerilTopic, routing.GameLogKey{Username: dw.Attacker.Username}.String(), pubsub.Envelope[routing.GameLog]{
+				Value: routing.GameLog{
+					CurrentTime: time.Now(),
+					Message:     message,
+					Username:    gs.Player.Username,
+				},
+			}, pubsub.WithCodec(pubsub.Gob), pubsub.WithDerivedMessageID(ctx, "log"))
+		})
+		if err != nil {
+			// Handling it again would fight the war twice; keep it for
+			// inspection instead
+			log.Printf("could not save war outcome: %v", err)
+			return pubsub.NackDiscard
 		}
-
-		fmt.Println("error: unknown war outcome")
-		return pubsub.NackDiscard
+		return pubsub.Ack
 	}
 }
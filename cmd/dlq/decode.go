@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"github.com/nguyenanhhao221/learn-pub-sub-starter/internal/gamelogic"
+	_ "github.com/nguyenanhhao221/learn-pub-sub-starter/internal/perilpb"
+	"github.com/nguyenanhhao221/learn-pub-sub-starter/internal/pubsub"
+	"github.com/nguyenanhhao221/learn-pub-sub-starter/internal/routing"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// payloadFor returns a pointer to the Peril type published under key, or nil
+// if the key is not one of ours.
+func payloadFor(key string) interface{} {
+	parsed, err := routing.ParseKey(key)
+	if err != nil {
+		return nil
+	}
+	switch parsed.(type) {
+	case routing.ArmyMoveKey:
+		return &gamelogic.ArmyMove{}
+	case routing.WarKey:
+		return &gamelogic.RecognitionOfWar{}
+	case routing.GameLogKey:
+		return &routing.GameLog{}
+	case routing.PauseStateKey:
+		return &routing.PlayingState{}
+	}
+	return nil
+}
+
+// decode renders the body as indented JSON, using the origin routing key from
+// the x-death header to pick the type to decode into.
+func decode(d amqp.Delivery) string {
+	key := d.RoutingKey
+	if _, origin, ok := pubsub.Origin(d.Headers); ok {
+		key = origin
+	}
+	v := payloadFor(key)
+
+	codec, ok := pubsub.CodecFor(d.ContentType)
+	if !ok {
+		return fmt.Sprintf("(unsupported content type %q)\n%s", d.ContentType, hex.Dump(d.Body))
+	}
+	if v == nil {
+		if codec == pubsub.Gob {
+			return fmt.Sprintf("(gob payload for unknown key %q)\n%s", key, hex.Dump(d.Body))
+		}
+		var generic interface{}
+		v = &generic
+	}
+	err := codec.Unmarshal(d.Body, v)
+	if err != nil {
+		return fmt.Sprintf("(could not decode: %v)\n%s", err, hex.Dump(d.Body))
+	}
+	pretty, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return fmt.Sprintf("(could not format: %v)", err)
+	}
+	return string(pretty)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/nguyenanhhao221/learn-pub-sub-starter/internal/gamelogic"
@@ -8,10 +9,10 @@ import (
 	"github.com/nguyenanhhao221/learn-pub-sub-starter/internal/routing"
 )
 
-func handlerLog() func(gl routing.GameLog) pubsub.AckType {
-	return func(gl routing.GameLog) pubsub.AckType {
+func handlerLogs() func(ctx context.Context, gls []routing.GameLog) pubsub.AckType {
+	return func(ctx context.Context, gls []routing.GameLog) pubsub.AckType {
 		defer fmt.Printf("> ")
-		err := gamelogic.WriteLog(gl)
+		err := gamelogic.WriteLogs(gls)
 		if err != nil {
 			fmt.Printf("error: %s\n", err)
 			return pubsub.NackRequeue
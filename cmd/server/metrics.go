@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/nguyenanhhao221/learn-pub-sub-starter/internal/gamelogic"
+	"github.com/nguyenanhhao221/learn-pub-sub-starter/internal/pubsub"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// activeWindow is how recently a player must have moved or fought to count
+// as active.
+const activeWindow = 5 * time.Minute
+
+var (
+	activePlayersDesc = prometheus.NewDesc("peril_active_players", "Players that moved or fought in the last five minutes.", nil, nil)
+	playerUnitsDesc   = prometheus.NewDesc("peril_player_units", "Units held by each active player as of their last move or war.", []string{"player"}, nil)
+	warsDesc          = prometheus.NewDesc("peril_wars_total", "Wars recognised since the server started.", nil, nil)
+)
+
+// gameStats follows army moves and war recognitions to export game-level
+// metrics. It implements prometheus.Collector.
+type gameStats struct {
+	mu       sync.Mutex
+	lastSeen map[string]time.Time
+	units    map[string]int
+	wars     int
+}
+
+func newGameStats() *gameStats {
+	return &gameStats{
+		lastSeen: map[string]time.Time{},
+		units:    map[string]int{},
+	}
+}
+
+func (s *gameStats) see(p gamelogic.Player) {
+	s.lastSeen[p.Username] = time.Now()
+	s.units[p.Username] = len(p.Units)
+}
+
+func (s *gameStats) handleMove() func(context.Context, gamelogic.ArmyMove) pubsub.AckType {
+	return func(_ context.Context, move gamelogic.ArmyMove) pubsub.AckType {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.see(move.Player)
+		return pubsub.Ack
+	}
+}
+
+func (s *gameStats) handleWar() func(context.Context, gamelogic.RecognitionOfWar) pubsub.AckType {
+	return func(_ context.Context, rw gamelogic.RecognitionOfWar) pubsub.AckType {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.see(rw.Attacker)
+		s.see(rw.Defender)
+		s.wars++
+		return pubsub.Ack
+	}
+}
+
+func (s *gameStats) Describe(ch chan<- *prometheus.Desc) {
+	ch <- activePlayersDesc
+	ch <- playerUnitsDesc
+	ch <- warsDesc
+}
+
+func (s *gameStats) Collect(ch chan<- prometheus.Metric) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	active := 0
+	for player, seen := range s.lastSeen {
+		if time.Since(seen) > activeWindow {
+			delete(s.lastSeen, player)
+			delete(s.units, player)
+			continue
+		}
+		active++
+		ch <- prometheus.MustNewConstMetric(playerUnitsDesc, prometheus.GaugeValue, float64(s.units[player]), player)
+	}
+	ch <- prometheus.MustNewConstMetric(activePlayersDesc, prometheus.GaugeValue, float64(active))
+	ch <- prometheus.MustNewConstMetric(warsDesc, prometheus.CounterValue, float64(s.wars))
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/nguyenanhhao221/learn-pub-sub-starter/internal/pubsub"
+	"github.com/nguyenanhhao221/learn-pub-sub-starter/internal/routing"
+)
+
+// replayLogs prints the game logs published since the given time, read from
+// the game log stream the topology declares, returning once no more have
+// arrived for a second.
+func replayLogs(ctx context.Context, broker pubsub.Broker, since time.Time) error {
+	received := make(chan struct{}, 1)
+	sub, err := pubsub.SubscribeGob(ctx, broker, routing.ExchangePerilTopic, routing.GameLogStreamQueue, routing.GameLogPattern, pubsub.SimpleQueueStream, func(_ context.Context, gl routing.GameLog) pubsub.AckType {
+		fmt.Printf("%v %v: %v\n", gl.CurrentTime.Format(time.RFC3339), gl.Username, gl.Message)
+		select {
+		case received <- struct{}{}:
+		default:
+		}
+		return pubsub.Ack
+	},
+		pubsub.WithStreamOffset(pubsub.StreamOffsetAt(since)),
+		pubsub.WithoutMiddleware(),
+	)
+	if err != nil {
+		return err
+	}
+	for idle := false; !idle; {
+		select {
+		case <-received:
+		case <-time.After(time.Second):
+			idle = true
+		case <-ctx.Done():
+			idle = true
+		}
+	}
+	return sub.Close()
+}
@@ -7,6 +7,8 @@ import (
 	"math/rand"
 	"os"
 	"strings"
+
+	"github.com/nguyenanhhao221/learn-pub-sub-starter/internal/routing"
 )
 
 func PrintClientHelp() {
@@ -33,6 +35,9 @@ func ClientWelcome() (string, error) {
 		return "", errors.New("you must enter a username. goodbye")
 	}
 	username := words[0]
+	if err := routing.ValidateUsername(username); err != nil {
+		return "", err
+	}
 	fmt.Printf("Welcome, %s!\n", username)
 	PrintClientHelp()
 	return username, nil
@@ -40,8 +45,10 @@ func ClientWelcome() (string, error) {
 
 func PrintServerHelp() {
 	fmt.Println("Possible commands:")
-	fmt.Println("* pause")
+	fmt.Println("* pause [duration]")
 	fmt.Println("* resume")
+	fmt.Println("* cancel <scheduled message ID>")
+	fmt.Println("* replay [duration]")
 	fmt.Println("* quit")
 	fmt.Println("* help")
 }
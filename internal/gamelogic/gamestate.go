@@ -61,6 +61,16 @@ func (gs *GameState) UpdateUnit(u Unit) {
 	gs.Player.Units[u.ID] = u
 }
 
+// RestorePlayer replaces the player's units with those of a saved snapshot.
+func (gs *GameState) RestorePlayer(p Player) {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	gs.Player.Units = map[int]Unit{}
+	for id, u := range p.Units {
+		gs.Player.Units[id] = u
+	}
+}
+
 func (gs *GameState) GetUsername() string {
 	return gs.Player.Username
 }
@@ -30,3 +30,25 @@ func WriteLog(gamelog routing.GameLog) error {
 	}
 	return nil
 }
+
+// WriteLogs appends several game logs with a single write to disk.
+func WriteLogs(gamelogs []routing.GameLog) error {
+	log.Printf("received %d game logs...", len(gamelogs))
+	time.Sleep(writeToDiskSleep)
+
+	f, err := os.OpenFile(logsFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("could not open logs file: %v", err)
+	}
+	defer f.Close()
+
+	var str string
+	for _, gamelog := range gamelogs {
+		str += fmt.Sprintf("%v %v: %v\n", gamelog.CurrentTime.Format(time.RFC3339), gamelog.Username, gamelog.Message)
+	}
+	_, err = f.WriteString(str)
+	if err != nil {
+		return fmt.Errorf("could not write to logs file: %v", err)
+	}
+	return nil
+}
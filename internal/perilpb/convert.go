@@ -0,0 +1,143 @@
+// Package perilpb holds the Protocol Buffers schema for every message Peril
+// puts on the wire, so tools outside Go can read and write them.
+package perilpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative peril.proto
+
+import (
+	"github.com/nguyenanhhao221/learn-pub-sub-starter/internal/gamelogic"
+	"github.com/nguyenanhhao221/learn-pub-sub-starter/internal/pubsub"
+	"github.com/nguyenanhhao221/learn-pub-sub-starter/internal/routing"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Importing this package registers the conversions below with
+// pubsub.Protobuf, so the Peril structs can be published and consumed as
+// application/x-protobuf.
+func init() {
+	pubsub.RegisterProtoType(FromPlayingState, ToPlayingState)
+	pubsub.RegisterProtoType(FromGameLog, ToGameLog)
+	pubsub.RegisterProtoType(FromArmyMove, ToArmyMove)
+	pubsub.RegisterProtoType(FromRecognitionOfWar, ToRecognitionOfWar)
+}
+
+func FromPlayingState(ps routing.PlayingState) *PlayingState {
+	return &PlayingState{IsPaused: ps.IsPaused}
+}
+
+func ToPlayingState(m *PlayingState) routing.PlayingState {
+	return routing.PlayingState{IsPaused: m.GetIsPaused()}
+}
+
+func FromGameLog(gl routing.GameLog) *GameLog {
+	return &GameLog{
+		CurrentTime: timestamppb.New(gl.CurrentTime),
+		Message:     gl.Message,
+		Username:    gl.Username,
+	}
+}
+
+func ToGameLog(m *GameLog) routing.GameLog {
+	gl := routing.GameLog{
+		Message:  m.GetMessage(),
+		Username: m.GetUsername(),
+	}
+	if m.GetCurrentTime() != nil {
+		gl.CurrentTime = m.GetCurrentTime().AsTime()
+	}
+	return gl
+}
+
+func FromArmyMove(move gamelogic.ArmyMove) *ArmyMove {
+	units := make([]*Unit, 0, len(move.Units))
+	for _, u := range move.Units {
+		units = append(units, FromUnit(u))
+	}
+	return &ArmyMove{
+		Player:     FromPlayer(move.Player),
+		Units:      units,
+		ToLocation: string(move.ToLocation),
+	}
+}
+
+func ToArmyMove(m *ArmyMove) gamelogic.ArmyMove {
+	units := make([]gamelogic.Unit, 0, len(m.GetUnits()))
+	for _, u := range m.GetUnits() {
+		units = append(units, ToUnit(u))
+	}
+	return gamelogic.ArmyMove{
+		Player:     ToPlayer(m.GetPlayer()),
+		Units:      units,
+		ToLocation: gamelogic.Location(m.GetToLocation()),
+	}
+}
+
+func FromRecognitionOfWar(rw gamelogic.RecognitionOfWar) *RecognitionOfWar {
+	return &RecognitionOfWar{
+		Attacker: FromPlayer(rw.Attacker),
+		Defender: FromPlayer(rw.Defender),
+	}
+}
+
+func ToRecognitionOfWar(m *RecognitionOfWar) gamelogic.RecognitionOfWar {
+	return gamelogic.RecognitionOfWar{
+		Attacker: ToPlayer(m.GetAttacker()),
+		Defender: ToPlayer(m.GetDefender()),
+	}
+}
+
+func FromPlayer(p gamelogic.Player) *Player {
+	units := make(map[int64]*Unit, len(p.Units))
+	for id, u := range p.Units {
+		units[int64(id)] = FromUnit(u)
+	}
+	return &Player{Username: p.Username, Units: units}
+}
+
+func ToPlayer(m *Player) gamelogic.Player {
+	units := make(map[int]gamelogic.Unit, len(m.GetUnits()))
+	for id, u := range m.GetUnits() {
+		units[int(id)] = ToUnit(u)
+	}
+	return gamelogic.Player{Username: m.GetUsername(), Units: units}
+}
+
+func FromUnit(u gamelogic.Unit) *Unit {
+	return &Unit{
+		Id:       int64(u.ID),
+		Rank:     FromUnitRank(u.Rank),
+		Location: string(u.Location),
+	}
+}
+
+func ToUnit(m *Unit) gamelogic.Unit {
+	return gamelogic.Unit{
+		ID:       int(m.GetId()),
+		Rank:     ToUnitRank(m.GetRank()),
+		Location: gamelogic.Location(m.GetLocation()),
+	}
+}
+
+func FromUnitRank(rank gamelogic.UnitRank) UnitRank {
+	switch rank {
+	case gamelogic.RankInfantry:
+		return UnitRank_UNIT_RANK_INFANTRY
+	case gamelogic.RankCavalry:
+		return UnitRank_UNIT_RANK_CAVALRY
+	case gamelogic.RankArtillery:
+		return UnitRank_UNIT_RANK_ARTILLERY
+	}
+	return UnitRank_UNIT_RANK_UNSPECIFIED
+}
+
+func ToUnitRank(rank UnitRank) gamelogic.UnitRank {
+	switch rank {
+	case UnitRank_UNIT_RANK_INFANTRY:
+		return gamelogic.RankInfantry
+	case UnitRank_UNIT_RANK_CAVALRY:
+		return gamelogic.RankCavalry
+	case UnitRank_UNIT_RANK_ARTILLERY:
+		return gamelogic.RankArtillery
+	}
+	return ""
+}
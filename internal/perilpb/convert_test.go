@@ -0,0 +1,97 @@
+package perilpb
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/nguyenanhhao221/learn-pub-sub-starter/internal/gamelogic"
+	"github.com/nguyenanhhao221/learn-pub-sub-starter/internal/pubsub"
+	"github.com/nguyenanhhao221/learn-pub-sub-starter/internal/routing"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+var (
+	testAlice = gamelogic.Player{Username: "alice", Units: map[int]gamelogic.Unit{
+		1: {ID: 1, Rank: gamelogic.RankInfantry, Location: "europe"},
+		2: {ID: 2, Rank: gamelogic.RankArtillery, Location: "asia"},
+	}}
+	testBob = gamelogic.Player{Username: "bob", Units: map[int]gamelogic.Unit{
+		3: {ID: 3, Rank: gamelogic.RankCavalry, Location: "europe"},
+	}}
+	testMove = gamelogic.ArmyMove{
+		Player:     testAlice,
+		Units:      []gamelogic.Unit{testAlice.Units[1]},
+		ToLocation: "europe",
+	}
+)
+
+func TestProtobufRoundTrip(t *testing.T) {
+	cases := []struct {
+		name  string
+		value any
+		// into returns a pointer to a zero value of value's type.
+		into func() any
+	}{
+		{"playing state", routing.PlayingState{IsPaused: true}, func() any { return new(routing.PlayingState) }},
+		{"game log", routing.GameLog{CurrentTime: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC), Message: "alice won", Username: "alice"}, func() any { return new(routing.GameLog) }},
+		{"army move", testMove, func() any { return new(gamelogic.ArmyMove) }},
+		{"recognition of war", gamelogic.RecognitionOfWar{Attacker: testAlice, Defender: testBob}, func() any { return new(gamelogic.RecognitionOfWar) }},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			body, err := pubsub.Protobuf.Marshal(c.value)
+			if err != nil {
+				t.Fatalf("Marshal: %v", err)
+			}
+			into := c.into()
+			if err := pubsub.Protobuf.Unmarshal(body, into); err != nil {
+				t.Fatalf("Unmarshal: %v", err)
+			}
+			if got := reflect.ValueOf(into).Elem().Interface(); !reflect.DeepEqual(got, c.value) {
+				t.Errorf("round trip = %+v, want %+v", got, c.value)
+			}
+		})
+	}
+}
+
+func TestSubscribeDecodesProtobuf(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	conn := pubsub.NewMemoryBroker().Connect()
+	defer conn.Close()
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatalf("Channel: %v", err)
+	}
+	defer ch.Close()
+	if err := ch.ExchangeDeclare(routing.ExchangePerilTopic, amqp.ExchangeTopic, true, false, false, false, nil); err != nil {
+		t.Fatalf("ExchangeDeclare: %v", err)
+	}
+	moves := make(chan gamelogic.ArmyMove, 1)
+	sub, err := pubsub.Subscribe(ctx, conn, routing.ExchangePerilTopic, "", routing.ArmyMovesPattern, pubsub.SimpleQueueTransient, func(_ context.Context, move gamelogic.ArmyMove) pubsub.AckType {
+		moves <- move
+		return pubsub.Ack
+	}, pubsub.WithoutMiddleware())
+	if err != nil {
+		t.Fatalf("Subscribe: %v", err)
+	}
+	defer sub.Close()
+
+	pub, err := pubsub.NewConfirmingPublisher(ch, 5*time.Second)
+	if err != nil {
+		t.Fatalf("NewConfirmingPublisher: %v", err)
+	}
+	if err := pubsub.Publish(ctx, pub, routing.ExchangePerilTopic, routing.ArmyMoveKey{Username: "alice"}.String(), testMove, pubsub.WithCodec(pubsub.Protobuf)); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+	select {
+	case got := <-moves:
+		if !reflect.DeepEqual(got, testMove) {
+			t.Errorf("handler got %+v, want %+v", got, testMove)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the move")
+	}
+}
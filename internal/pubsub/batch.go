@@ -0,0 +1,337 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// BatchPublisher collects messages and publishes them in groups through a
+// DeferredPublisher: a batch is sent once it holds size messages or delay
+// after its first message, whichever comes first, and all of its confirms are
+// awaited together. Each message still gets its own DeferredConfirm, so
+// failures are reported per message. Batches are published in order, one at
+// a time.
+type BatchPublisher struct {
+	p     DeferredPublisher
+	size  int
+	delay time.Duration
+
+	mu      sync.Mutex
+	pending []batchItem
+	gen     uint64
+	timer   *time.Timer
+	closed  bool
+
+	batches chan []batchItem
+	done    chan struct{}
+}
+
+type batchItem struct {
+	ctx      context.Context
+	exchange string
+	key      string
+	msg      amqp.Publishing
+	result   *DeferredConfirm
+}
+
+// NewBatchPublisher starts batching publishes to p. p must not be closed
+// before the BatchPublisher.
+func NewBatchPublisher(p DeferredPublisher, size int, delay time.Duration) *BatchPublisher {
+	b := &BatchPublisher{
+		p:       p,
+		size:    max(size, 1),
+		delay:   delay,
+		batches: make(chan []batchItem),
+		done:    make(chan struct{}),
+	}
+	go b.run()
+	return b
+}
+
+// PublishBatched encodes val like Publish and adds it to b's current batch.
+// The returned DeferredConfirm completes once the broker has confirmed or
+// rejected the message.
+func PublishBatched[T any](ctx context.Context, b *BatchPublisher, exchange, key string, val T, opts ...PublishOption) (*DeferredConfirm, error) {
+	msg, err := encode(Envelope[T]{Value: val}, newPublishOptions(opts))
+	if err != nil {
+		return nil, err
+	}
+	return b.Add(ctx, exchange, key, msg)
+}
+
+// Add adds msg to the current batch. ctx is used when the batch is sent, to
+// publish msg and to carry its trace.
+func (b *BatchPublisher) Add(ctx context.Context, exchange, key string, msg amqp.Publishing) (*DeferredConfirm, error) {
+	if msg.MessageId == "" {
+		msg.MessageId = newMessageID()
+	}
+	d := &DeferredConfirm{done: make(chan struct{})}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil, amqp.ErrClosed
+	}
+	b.pending = append(b.pending, batchItem{ctx: ctx, exchange: exchange, key: key, msg: msg, result: d})
+	switch {
+	case len(b.pending) >= b.size:
+		b.flushLocked()
+	case len(b.pending) == 1:
+		gen := b.gen
+		b.timer = time.AfterFunc(b.delay, func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			if b.gen == gen && !b.closed {
+				b.flushLocked()
+			}
+		})
+	}
+	return d, nil
+}
+
+// Flush sends the current batch without waiting for it to fill, and waits
+// until every message in it is confirmed or ctx is done. The error joins
+// those of the messages that failed.
+func (b *BatchPublisher) Flush(ctx context.Context) error {
+	b.mu.Lock()
+	batch := b.pending
+	b.flushLocked()
+	b.mu.Unlock()
+	return waitBatch(ctx, batch)
+}
+
+// Close flushes the current batch, waits for it like Flush, and stops b.
+// Later calls to Add fail.
+func (b *BatchPublisher) Close(ctx context.Context) error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil
+	}
+	batch := b.pending
+	b.flushLocked()
+	b.closed = true
+	close(b.batches)
+	b.mu.Unlock()
+	return waitBatch(ctx, batch)
+}
+
+// flushLocked hands the current batch to run. It blocks while run is busy
+// with the previous batch, which holds back Add when the broker is slow.
+func (b *BatchPublisher) flushLocked() {
+	if len(b.pending) == 0 {
+		return
+	}
+	batch := b.pending
+	b.pending = nil
+	b.gen++
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+	b.batches <- batch
+}
+
+func waitBatch(ctx context.Context, batch []batchItem) error {
+	var errs []error
+	for _, item := range batch {
+		if err := item.result.Wait(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("message %s: %w", item.msg.MessageId, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (b *BatchPublisher) run() {
+	defer close(b.done)
+	for batch := range b.batches {
+		b.publish(batch)
+	}
+}
+
+// publish sends every message in batch before waiting for any confirm.
+func (b *BatchPublisher) publish(batch []batchItem) {
+	type inflight struct {
+		item    batchItem
+		span    trace.Span
+		confirm *DeferredConfirm
+	}
+	start := time.Now()
+	sent := make([]inflight, 0, len(batch))
+	for _, item := range batch {
+		msg := item.msg
+		msg.Headers = copyTable(msg.Headers)
+		if msg.Headers == nil {
+			msg.Headers = amqp.Table{}
+		}
+		ctx, span := startPublishSpan(item.ctx, item.exchange, item.key, msg, msg.Headers)
+		d, err := b.p.PublishDeferred(ctx, item.exchange, item.key, msg)
+		if err != nil {
+			finishBatchItem(item, span, start, err)
+			continue
+		}
+		sent = append(sent, inflight{item: item, span: span, confirm: d})
+	}
+
+	ctx := context.Background()
+	if timeout := b.p.ConfirmTimeout(); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	for _, f := range sent {
+		finishBatchItem(f.item, f.span, start, f.confirm.Wait(ctx))
+	}
+}
+
+// finishBatchItem records the outcome of a batched publish and completes its
+// DeferredConfirm.
+func finishBatchItem(item batchItem, span trace.Span, start time.Time, err error) {
+	publishDuration.WithLabelValues(item.exchange).Observe(time.Since(start).Seconds())
+	publishedTotal.WithLabelValues(item.exchange, publishOutcome(err)).Inc()
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+	item.result.err = err
+	close(item.result.done)
+}
+
+// SubscribeBatch is Subscribe for handlers that process several messages at
+// a time. The handler gets up to size messages, as many as arrive within
+// wait of the first one, and its AckType settles them all with a single
+// multiple ack or nack. Deliveries that cannot be decoded, or whose routing
+// key WithKeyParser rejects, are settled on their own and left out of the
+// batch. With WithRetry, a NackRequeue retries every message of the batch
+// separately.
+// Middleware sees the batch as a []T value; the Metadata it gets is that of
+// the last delivery, with Batch holding the Metadata of each message in the
+// batch. WithConcurrency and WithKeyOrdering do not apply: batches are
+// handled one at a time, in delivery order.
+func SubscribeBatch[T any](ctx context.Context, conn Broker, exchange, queueName, key string, simpleQueueType SimpleQueueType, size int, wait time.Duration, handler func(context.Context, []T) AckType, opts ...SubscribeOption) (*Subscription, error) {
+	options := newSubscribeOptions(opts)
+	size = max(size, 1)
+
+	// Prefetch enough to fill the next batch while the handler runs
+	amqpCh, amqpQueue, tag, deliveryCh, err := consume(conn, exchange, queueName, key, simpleQueueType, max(defaultPrefetch, 2*size), options)
+	if err != nil {
+		return nil, err
+	}
+
+	wrapped := chain(func(ctx context.Context, value any, meta Metadata) AckType {
+		return handler(ctx, value.([]T))
+	}, append([]Middleware{Recover()}, options.middleware...))
+
+	sub := newSubscription(ctx, amqpCh, tag)
+
+	process := func(deliveries []amqp.Delivery) {
+		spanCtx, span := startBatchSpan(sub.ctx, amqpQueue.Name, deliveries)
+		values := make([]T, 0, len(deliveries))
+		metas := make([]Metadata, 0, len(deliveries))
+		kept := make([]amqp.Delivery, 0, len(deliveries))
+		for _, delivery := range deliveries {
+			meta, err := metadataFor(delivery, options)
+			if err != nil {
+				ackType := keyRejected(amqpQueue.Name, delivery, err)
+				consumedTotal.WithLabelValues(amqpQueue.Name, ackType.String()).Inc()
+				settle(delivery, ackType)
+				continue
+			}
+			v, err := decode[T](delivery, options)
+			if err != nil {
+				ackType := decodeFailed(amqpQueue.Name, delivery, err, options)
+				consumedTotal.WithLabelValues(amqpQueue.Name, ackType.String()).Inc()
+				settle(delivery, ackType)
+				continue
+			}
+			values = append(values, v)
+			metas = append(metas, meta)
+			kept = append(kept, delivery)
+		}
+		if len(kept) == 0 {
+			endConsumeSpan(span, NackDiscard, errors.New("no message in the batch could be decoded"))
+			return
+		}
+
+		meta := metas[len(metas)-1]
+		meta.Batch = metas
+		handlerCtx := contextWithMetadata(spanCtx, meta)
+		if options.timeout > 0 {
+			var cancel context.CancelFunc
+			handlerCtx, cancel = context.WithTimeout(handlerCtx, options.timeout)
+			defer cancel()
+		}
+		start := time.Now()
+		ackType := wrapped(handlerCtx, values, meta)
+		handlerDuration.WithLabelValues(amqpQueue.Name).Observe(time.Since(start).Seconds())
+		endConsumeSpan(span, ackType, nil)
+
+		if ackType == NackRequeue && options.retry != nil {
+			for _, delivery := range kept {
+				retried := options.retry.retry(amqpCh, amqpQueue.Name, delivery)
+				consumedTotal.WithLabelValues(amqpQueue.Name, retried.String()).Inc()
+				settle(delivery, retried)
+			}
+			return
+		}
+		consumedTotal.WithLabelValues(amqpQueue.Name, ackType.String()).Add(float64(len(kept)))
+		// Everything before the last delivery on this channel is either in
+		// the batch or already settled, so one multiple ack covers the batch.
+		settleMultiple(kept[len(kept)-1], ackType)
+	}
+
+	go func() {
+		collect(deliveryCh, size, wait, process)
+		sub.stop()
+	}()
+
+	return sub, nil
+}
+
+// collect groups deliveries into batches of up to size, sending a partial
+// batch once wait has passed since its first delivery.
+func collect(deliveries <-chan amqp.Delivery, size int, wait time.Duration, process func([]amqp.Delivery)) {
+	for first := range deliveries {
+		batch := []amqp.Delivery{first}
+		timer := time.NewTimer(wait)
+		open := true
+		for open && len(batch) < size {
+			select {
+			case d, ok := <-deliveries:
+				if !ok {
+					open = false
+					continue
+				}
+				batch = append(batch, d)
+			case <-timer.C:
+				open = false
+			}
+		}
+		timer.Stop()
+		process(batch)
+	}
+}
+
+// settleMultiple settles delivery and every earlier unsettled delivery on
+// its channel according to ackType.
+func settleMultiple(delivery amqp.Delivery, ackType AckType) {
+	var err error
+	switch ackType {
+	case Ack:
+		err = delivery.Ack(true)
+	case NackRequeue:
+		err = delivery.Nack(true, true)
+	case NackDiscard:
+		err = delivery.Nack(true, false)
+	}
+	if err != nil {
+		fmt.Printf("failed to settle batch: %v\n", err)
+	}
+}
@@ -0,0 +1,138 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestSubscribeBatchSettlesTogether(t *testing.T) {
+	cases := []struct {
+		ack          AckType
+		deadLettered int
+	}{
+		{Ack, 0},
+		{NackDiscard, 5},
+	}
+	for _, tb := range testBrokers(t) {
+		t.Run(tb.name, func(t *testing.T) {
+			conn := tb.connect(t)
+			exchange := declareTestExchange(t, conn, amqp.ExchangeTopic)
+			pub := newTestPublisher(t, conn)
+			for _, c := range cases {
+				t.Run(c.ack.String(), func(t *testing.T) {
+					dlx, dlq := declareDeadLetters(t, tb, conn)
+					queue := testName("queue")
+					tb.remove(t, queue)
+					// Publish the whole batch before subscribing, so it is
+					// collected in one go
+					ch, _, err := DeclareAndBind(conn, exchange, queue, "game_logs.*", SimpleQueueDurable, WithDeadLetterExchange(dlx))
+					if err != nil {
+						t.Fatalf("DeclareAndBind: %v", err)
+					}
+					ch.Close()
+					for i := 0; i < 5; i++ {
+						if err := PublishJSON(context.Background(), pub, exchange, "game_logs.alice", i); err != nil {
+							t.Fatalf("PublishJSON: %v", err)
+						}
+					}
+
+					batches := make(chan []int, 1)
+					sub, err := SubscribeBatch(testContext(t), conn, exchange, queue, "game_logs.*", SimpleQueueDurable, 5, time.Second, func(_ context.Context, batch []int) AckType {
+						batches <- batch
+						return c.ack
+					}, WithQueueOptions(WithDeadLetterExchange(dlx)), WithoutMiddleware())
+					if err != nil {
+						t.Fatalf("SubscribeBatch: %v", err)
+					}
+					if got := receive(t, batches); fmt.Sprint(got) != "[0 1 2 3 4]" {
+						t.Fatalf("batch = %v, want [0 1 2 3 4]", got)
+					}
+					sub.Close()
+					eventually(t, "the batch is dead-lettered", func() bool {
+						return queueLen(t, conn, dlq) == c.deadLettered
+					})
+					if n := queueLen(t, conn, queue); n != 0 {
+						t.Errorf("%d messages left in the queue, want none", n)
+					}
+				})
+			}
+		})
+	}
+}
+
+func TestBatchPublisher(t *testing.T) {
+	cases := []struct {
+		name string
+		size int
+		// keys are published in order; "unbound" has no queue.
+		keys []string
+	}{
+		{"one full batch", 3, []string{"key", "key", "key"}},
+		{"several batches", 2, []string{"key", "key", "key", "key", "key"}},
+		{"one message unrouted", 4, []string{"key", "unbound", "key"}},
+	}
+	for _, tb := range testBrokers(t) {
+		t.Run(tb.name, func(t *testing.T) {
+			conn := tb.connect(t)
+			pub := newTestPublisher(t, conn)
+			for _, c := range cases {
+				t.Run(c.name, func(t *testing.T) {
+					exchange := declareTestExchange(t, conn, amqp.ExchangeDirect)
+					ch, q, err := DeclareAndBind(conn, exchange, "", "key", SimpleQueueTransient)
+					if err != nil {
+						t.Fatalf("DeclareAndBind: %v", err)
+					}
+					defer ch.Close()
+					// The delay is long enough that only full batches and
+					// Close send anything
+					b := NewBatchPublisher(pub, c.size, time.Minute)
+					var confirms []*DeferredConfirm
+					for i, key := range c.keys {
+						d, err := PublishBatched(context.Background(), b, exchange, key, i)
+						if err != nil {
+							t.Fatalf("PublishBatched: %v", err)
+						}
+						confirms = append(confirms, d)
+					}
+					ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+					defer cancel()
+					// Close reports the failures of the batch it sends, which
+					// are checked one by one below
+					var returned *ReturnError
+					if err := b.Close(ctx); err != nil && !errors.As(err, &returned) {
+						t.Fatalf("Close: %v", err)
+					}
+
+					var routed []int
+					for i, d := range confirms {
+						err := d.Wait(ctx)
+						switch {
+						case c.keys[i] == "unbound" && !errors.As(err, &returned):
+							t.Errorf("publish %d = %v, want a *ReturnError", i, err)
+						case c.keys[i] != "unbound" && err != nil:
+							t.Errorf("publish %d = %v, want nil", i, err)
+						case err == nil:
+							routed = append(routed, i)
+						}
+					}
+					var got []int
+					for range routed {
+						var v int
+						if err := JSON.Unmarshal(getMessage(t, conn, q.Name).Body, &v); err != nil {
+							t.Fatalf("Unmarshal: %v", err)
+						}
+						got = append(got, v)
+					}
+					if fmt.Sprint(got) != fmt.Sprint(routed) {
+						t.Errorf("queue got %v, want %v in order", got, routed)
+					}
+				})
+			}
+		})
+	}
+}
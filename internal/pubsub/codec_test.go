@@ -0,0 +1,110 @@
+package pubsub
+
+import (
+	"context"
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+type testMove struct {
+	Player string
+	Units  int
+}
+
+func TestSubscribeDecodesByContentType(t *testing.T) {
+	want := testMove{Player: "alice", Units: 3}
+	cases := []struct {
+		name        string
+		codec       Codec
+		contentType string
+		// poison reports whether the delivery cannot be decoded.
+		poison bool
+	}{
+		{"json", JSON, "application/json", false},
+		{"gob", Gob, "application/gob", false},
+		{"msgpack", MessagePack, "application/msgpack", false},
+		{"msgpack alias", MessagePack, "application/x-msgpack", false},
+		{"cbor", CBOR, "application/cbor", false},
+		{"parameters ignored", JSON, "application/json; charset=utf-8", false},
+		{"no content type uses the default", Gob, "", false},
+		{"unregistered content type", JSON, "text/plain", true},
+		{"content type of another codec", JSON, "application/gob", true},
+	}
+	for _, tb := range testBrokers(t) {
+		t.Run(tb.name, func(t *testing.T) {
+			conn := tb.connect(t)
+			exchange := declareTestExchange(t, conn, amqp.ExchangeTopic)
+			pub := newTestPublisher(t, conn)
+			for _, c := range cases {
+				t.Run(c.name, func(t *testing.T) {
+					dlx, dlq := declareDeadLetters(t, tb, conn)
+					moves := make(chan testMove, 1)
+					sub, err := Subscribe(testContext(t), conn, exchange, "", "army_moves.*", SimpleQueueTransient, func(_ context.Context, m testMove) AckType {
+						moves <- m
+						return Ack
+					}, WithDefaultCodec(Gob), WithQueueOptions(WithDeadLetterExchange(dlx)), WithoutMiddleware())
+					if err != nil {
+						t.Fatalf("Subscribe: %v", err)
+					}
+					defer sub.Close()
+
+					body, err := c.codec.Marshal(want)
+					if err != nil {
+						t.Fatalf("Marshal: %v", err)
+					}
+					msg := amqp.Publishing{ContentType: c.contentType, Body: body}
+					if err := pub.PublishWithContext(context.Background(), exchange, "army_moves.alice", true, false, msg); err != nil {
+						t.Fatalf("PublishWithContext: %v", err)
+					}
+					if c.poison {
+						getMessage(t, conn, dlq)
+						return
+					}
+					if got := receive(t, moves); got != want {
+						t.Errorf("handler got %+v, want %+v", got, want)
+					}
+				})
+			}
+		})
+	}
+}
+
+func TestPublishSetsContentType(t *testing.T) {
+	cases := []struct {
+		name  string
+		codec Codec
+	}{
+		{"json", JSON},
+		{"gob", Gob},
+		{"msgpack", MessagePack},
+		{"cbor", CBOR},
+	}
+	for _, tb := range testBrokers(t) {
+		t.Run(tb.name, func(t *testing.T) {
+			conn := tb.connect(t)
+			exchange := declareTestExchange(t, conn, amqp.ExchangeDirect)
+			pub := newTestPublisher(t, conn)
+			for _, c := range cases {
+				t.Run(c.name, func(t *testing.T) {
+					ch, q, err := DeclareAndBind(conn, exchange, "", "key", SimpleQueueTransient)
+					if err != nil {
+						t.Fatalf("DeclareAndBind: %v", err)
+					}
+					defer ch.Close()
+					if err := Publish(context.Background(), pub, exchange, "key", testMove{Player: "alice"}, WithCodec(c.codec)); err != nil {
+						t.Fatalf("Publish: %v", err)
+					}
+					d := getMessage(t, conn, q.Name)
+					if d.ContentType != c.codec.ContentType() {
+						t.Errorf("ContentType = %q, want %q", d.ContentType, c.codec.ContentType())
+					}
+					var got testMove
+					if err := c.codec.Unmarshal(d.Body, &got); err != nil || got.Player != "alice" {
+						t.Errorf("Unmarshal = %+v, %v; want the published move", got, err)
+					}
+				})
+			}
+		})
+	}
+}
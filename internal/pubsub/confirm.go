@@ -0,0 +1,240 @@
+package pubsub
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// ErrNacked is returned when the broker refuses a publish, or the channel
+// closes before confirming it.
+var ErrNacked = errors.New("pubsub: publish was not confirmed by the broker")
+
+// ReturnError is returned when a mandatory publish could not be routed to any
+// queue.
+type ReturnError struct {
+	Exchange   string
+	RoutingKey string
+	ReplyCode  uint16
+	ReplyText  string
+}
+
+func (e *ReturnError) Error() string {
+	return fmt.Sprintf("pubsub: message to exchange %q with key %q was returned: %d %s", e.Exchange, e.RoutingKey, e.ReplyCode, e.ReplyText)
+}
+
+// ConfirmingPublisher is a Publisher that puts its channel into confirm mode
+// and only reports success once the broker has acknowledged the message.
+// Every publish is mandatory, so a message no queue is bound for fails with a
+// *ReturnError instead of being dropped. The channel must not be used by
+// anything else while the publisher owns it.
+type ConfirmingPublisher struct {
+	ch      Channel
+	timeout time.Duration
+
+	// mu serialises publishes so each one's delivery tag is known up front.
+	mu  sync.Mutex
+	seq uint64
+
+	pendingMu sync.Mutex
+	pending   map[uint64]*DeferredConfirm
+	closed    error
+}
+
+// publishIDHeader tells apart publishes that share a message ID, as those
+// made with WithDerivedMessageID can, so a return is matched to the right
+// one.
+const publishIDHeader = "x-publish-id"
+
+// DeferredConfirm is the outcome of a publish that is waiting for the broker.
+type DeferredConfirm struct {
+	publishID string
+	done      chan struct{}
+	returned  *ReturnError
+	err       error
+}
+
+// Done is closed once the broker has confirmed or rejected the publish.
+func (d *DeferredConfirm) Done() <-chan struct{} {
+	return d.done
+}
+
+// Wait blocks until the publish is confirmed or ctx is done.
+func (d *DeferredConfirm) Wait(ctx context.Context) error {
+	select {
+	case <-d.done:
+		return d.err
+	case <-ctx.Done():
+		return fmt.Errorf("pubsub: publish not confirmed: %w", ctx.Err())
+	}
+}
+
+var _ Publisher = (*ConfirmingPublisher)(nil)
+
+// NewConfirmingPublisher enables confirm mode on ch. timeout bounds how long
+// PublishWithContext waits for a confirm when ctx has no deadline of its own.
+func NewConfirmingPublisher(ch Channel, timeout time.Duration) (*ConfirmingPublisher, error) {
+	if err := ch.Confirm(false); err != nil {
+		return nil, fmt.Errorf("could not put channel into confirm mode: %w", err)
+	}
+	p := &ConfirmingPublisher{
+		ch:      ch,
+		timeout: timeout,
+		pending: map[uint64]*DeferredConfirm{},
+	}
+	returns := ch.NotifyReturn(make(chan amqp.Return, 16))
+	confirms := ch.NotifyPublish(make(chan amqp.Confirmation, 16))
+	go p.listen(returns, confirms)
+	return p, nil
+}
+
+// DeferredPublisher publishes messages without waiting for their confirms.
+// *ConfirmingPublisher and *PublisherPool implement it.
+type DeferredPublisher interface {
+	PublishDeferred(ctx context.Context, exchange, key string, msg amqp.Publishing) (*DeferredConfirm, error)
+	// ConfirmTimeout is how long to wait for a confirm; zero means no limit.
+	ConfirmTimeout() time.Duration
+}
+
+// ConfirmTimeout returns the timeout the publisher was created with.
+func (p *ConfirmingPublisher) ConfirmTimeout() time.Duration {
+	return p.timeout
+}
+
+// PublishWithContext publishes msg and waits for the broker to confirm it.
+// mandatory and immediate are ignored: every publish is mandatory.
+func (p *ConfirmingPublisher) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	d, err := p.PublishDeferred(ctx, exchange, key, msg)
+	if err != nil {
+		return err
+	}
+	if _, ok := ctx.Deadline(); !ok && p.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.timeout)
+		defer cancel()
+	}
+	return d.Wait(ctx)
+}
+
+// PublishDeferred publishes msg without waiting for the confirm, so several
+// messages can be in flight at once. Messages without a MessageId are given
+// one. Returns are matched to their publish by a header unique to each
+// publish, since several messages in flight may share a MessageId.
+func (p *ConfirmingPublisher) PublishDeferred(ctx context.Context, exchange, key string, msg amqp.Publishing) (*DeferredConfirm, error) {
+	if msg.MessageId == "" {
+		msg.MessageId = newMessageID()
+	}
+	d := &DeferredConfirm{publishID: newMessageID(), done: make(chan struct{})}
+	msg.Headers = copyTable(msg.Headers)
+	if msg.Headers == nil {
+		msg.Headers = amqp.Table{}
+	}
+	msg.Headers[publishIDHeader] = d.publishID
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	tag := p.seq + 1
+	p.pendingMu.Lock()
+	if p.closed != nil {
+		p.pendingMu.Unlock()
+		return nil, p.closed
+	}
+	p.pending[tag] = d
+	p.pendingMu.Unlock()
+
+	if err := p.ch.PublishWithContext(ctx, exchange, key, true, false, msg); err != nil {
+		p.pendingMu.Lock()
+		delete(p.pending, tag)
+		p.pendingMu.Unlock()
+		return nil, err
+	}
+	p.seq = tag
+	return d, nil
+}
+
+func (p *ConfirmingPublisher) listen(returns <-chan amqp.Return, confirms <-chan amqp.Confirmation) {
+	for confirms != nil {
+		select {
+		case r, ok := <-returns:
+			if !ok {
+				returns = nil
+				continue
+			}
+			p.returned(r)
+		case c, ok := <-confirms:
+			if !ok {
+				confirms = nil
+				continue
+			}
+			// A return always precedes the confirm of the same publish.
+			for drained := false; !drained && returns != nil; {
+				select {
+				case r, ok := <-returns:
+					if !ok {
+						returns = nil
+						continue
+					}
+					p.returned(r)
+				default:
+					drained = true
+				}
+			}
+			p.confirmed(c)
+		}
+	}
+
+	p.pendingMu.Lock()
+	defer p.pendingMu.Unlock()
+	p.closed = amqp.ErrClosed
+	for tag, d := range p.pending {
+		d.err = ErrNacked
+		close(d.done)
+		delete(p.pending, tag)
+	}
+}
+
+func (p *ConfirmingPublisher) returned(r amqp.Return) {
+	p.pendingMu.Lock()
+	defer p.pendingMu.Unlock()
+	id, _ := r.Headers[publishIDHeader].(string)
+	for _, d := range p.pending {
+		if d.publishID == id {
+			d.returned = &ReturnError{
+				Exchange:   r.Exchange,
+				RoutingKey: r.RoutingKey,
+				ReplyCode:  r.ReplyCode,
+				ReplyText:  r.ReplyText,
+			}
+			return
+		}
+	}
+}
+
+func (p *ConfirmingPublisher) confirmed(c amqp.Confirmation) {
+	p.pendingMu.Lock()
+	defer p.pendingMu.Unlock()
+	d, ok := p.pending[c.DeliveryTag]
+	if !ok {
+		return
+	}
+	delete(p.pending, c.DeliveryTag)
+	switch {
+	case !c.Ack:
+		d.err = ErrNacked
+	case d.returned != nil:
+		d.err = d.returned
+	}
+	close(d.done)
+}
+
+func newMessageID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
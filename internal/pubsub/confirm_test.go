@@ -0,0 +1,103 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestConfirmingPublisher(t *testing.T) {
+	cases := []struct {
+		name string
+		key  string
+		// check reports what is wrong with the publish's error, if anything.
+		check func(err error) string
+	}{
+		{"routed", "routed", func(err error) string {
+			if err != nil {
+				return "want nil"
+			}
+			return ""
+		}},
+		{"no queue bound", "unbound", func(err error) string {
+			var returned *ReturnError
+			if !errors.As(err, &returned) || returned.ReplyCode != amqp.NoRoute || returned.RoutingKey != "unbound" {
+				return "want a *ReturnError for key unbound with code 312"
+			}
+			return ""
+		}},
+		{"queue full", "full", func(err error) string {
+			if !errors.Is(err, ErrNacked) {
+				return "want ErrNacked"
+			}
+			return ""
+		}},
+	}
+	for _, tb := range testBrokers(t) {
+		t.Run(tb.name, func(t *testing.T) {
+			conn := tb.connect(t)
+			exchange := declareTestExchange(t, conn, amqp.ExchangeDirect)
+			for key, opts := range map[string][]QueueOption{
+				"routed": nil,
+				"full":   {WithMaxLength(1, OverflowRejectPublish)},
+			} {
+				ch, _, err := DeclareAndBind(conn, exchange, "", key, SimpleQueueTransient, opts...)
+				if err != nil {
+					t.Fatalf("DeclareAndBind: %v", err)
+				}
+				defer ch.Close()
+			}
+			pub := newTestPublisher(t, conn)
+			if err := PublishJSON(context.Background(), pub, exchange, "full", "first"); err != nil {
+				t.Fatalf("PublishJSON: %v", err)
+			}
+			for _, c := range cases {
+				t.Run(c.name, func(t *testing.T) {
+					err := PublishJSON(context.Background(), pub, exchange, c.key, "hello")
+					if problem := c.check(err); problem != "" {
+						t.Errorf("PublishJSON = %v, %s", err, problem)
+					}
+				})
+			}
+		})
+	}
+}
+
+func TestConfirmingPublisherReturnsSharedMessageID(t *testing.T) {
+	for _, tb := range testBrokers(t) {
+		t.Run(tb.name, func(t *testing.T) {
+			conn := tb.connect(t)
+			exchange := declareTestExchange(t, conn, amqp.ExchangeDirect)
+			ch, _, err := DeclareAndBind(conn, exchange, "", "routed", SimpleQueueTransient)
+			if err != nil {
+				t.Fatalf("DeclareAndBind: %v", err)
+			}
+			defer ch.Close()
+			pub := newTestPublisher(t, conn)
+
+			// Derived IDs are shared by every copy of a message; only the one
+			// without a route must fail
+			msg := amqp.Publishing{MessageId: "shared", Body: []byte("hello")}
+			unrouted, err := pub.PublishDeferred(context.Background(), exchange, "unbound", msg)
+			if err != nil {
+				t.Fatalf("PublishDeferred: %v", err)
+			}
+			routed, err := pub.PublishDeferred(context.Background(), exchange, "routed", msg)
+			if err != nil {
+				t.Fatalf("PublishDeferred: %v", err)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			var returned *ReturnError
+			if err := unrouted.Wait(ctx); !errors.As(err, &returned) {
+				t.Errorf("unrouted publish = %v, want a *ReturnError", err)
+			}
+			if err := routed.Wait(ctx); err != nil {
+				t.Errorf("routed publish = %v, want nil", err)
+			}
+		})
+	}
+}
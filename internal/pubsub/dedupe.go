@@ -0,0 +1,243 @@
+package pubsub
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"log/slog"
+	"reflect"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// DedupeStore remembers handled message IDs beyond the lifetime of the
+// in-memory cache used by Dedupe, for example across restarts.
+type DedupeStore interface {
+	// Seen reports whether id was marked and has not yet expired.
+	Seen(id string) (bool, error)
+	// Mark records id as handled until expires.
+	Mark(id string, expires time.Time) error
+}
+
+// Dedupe acknowledges deliveries whose message ID was already handled
+// without calling the rest of the chain, so redeliveries after a NackRequeue
+// or a reconnect are handled once. A message counts as handled once the
+// chain returns Ack; IDs are remembered for ttl in an LRU cache of up to size
+// entries, and in store too when it is not nil. Deliveries without a message
+// ID are always handled. Publishers that republish in a handler should use
+// WithDerivedMessageID so the republished message is deduplicated as well.
+// In a SubscribeBatch subscription, duplicates are removed from the batch
+// and the rest of the chain is only called if any message is left.
+func Dedupe(size int, ttl time.Duration, store DedupeStore) Middleware {
+	cache := newLRUSet(size)
+	return func(next Handler) Handler {
+		return func(ctx context.Context, value any, meta Metadata) AckType {
+			if meta.Batch != nil {
+				return dedupeBatch(ctx, value, meta, next, cache, store, ttl)
+			}
+			id := meta.MessageID
+			if id == "" {
+				return next(ctx, value, meta)
+			}
+			if seen(cache, store, id) {
+				slog.Info("skipping duplicate message",
+					"routing_key", meta.RoutingKey,
+					"message_id", id,
+				)
+				return Ack
+			}
+			ack := next(ctx, value, meta)
+			if ack == Ack {
+				markHandled(cache, store, ttl, id)
+			}
+			return ack
+		}
+	}
+}
+
+// dedupeBatch calls next with the messages of a batch that were not handled
+// before. value is the batch's []T.
+func dedupeBatch(ctx context.Context, value any, meta Metadata, next Handler, cache *lruSet, store DedupeStore, ttl time.Duration) AckType {
+	values := reflect.ValueOf(value)
+	fresh := reflect.MakeSlice(values.Type(), 0, values.Len())
+	var metas []Metadata
+	for i, m := range meta.Batch {
+		if m.MessageID != "" && seen(cache, store, m.MessageID) {
+			slog.Info("skipping duplicate message",
+				"routing_key", m.RoutingKey,
+				"message_id", m.MessageID,
+			)
+			continue
+		}
+		fresh = reflect.Append(fresh, values.Index(i))
+		metas = append(metas, m)
+	}
+	if len(metas) == 0 {
+		return Ack
+	}
+	if len(metas) < len(meta.Batch) {
+		meta = metas[len(metas)-1]
+		meta.Batch = metas
+		ctx = contextWithMetadata(ctx, meta)
+	}
+	ack := next(ctx, fresh.Interface(), meta)
+	if ack == Ack {
+		for _, m := range metas {
+			if m.MessageID != "" {
+				markHandled(cache, store, ttl, m.MessageID)
+			}
+		}
+	}
+	return ack
+}
+
+func markHandled(cache *lruSet, store DedupeStore, ttl time.Duration, id string) {
+	expires := time.Now().Add(ttl)
+	cache.add(id, expires)
+	if store != nil {
+		if err := store.Mark(id, expires); err != nil {
+			slog.Warn("could not record handled message", "message_id", id, "err", err)
+		}
+	}
+}
+
+func seen(cache *lruSet, store DedupeStore, id string) bool {
+	if cache.contains(id) {
+		return true
+	}
+	if store == nil {
+		return false
+	}
+	ok, err := store.Seen(id)
+	if err != nil {
+		// Handling twice is better than not at all
+		slog.Warn("could not check for duplicate message", "message_id", id, "err", err)
+		return false
+	}
+	return ok
+}
+
+// lruSet is a set of IDs that expire, holding at most size of them and
+// evicting the least recently added first.
+type lruSet struct {
+	mu    sync.Mutex
+	size  int
+	order *list.List
+	items map[string]*list.Element
+}
+
+type lruEntry struct {
+	id      string
+	expires time.Time
+}
+
+func newLRUSet(size int) *lruSet {
+	return &lruSet{size: max(size, 1), order: list.New(), items: map[string]*list.Element{}}
+}
+
+func (s *lruSet) contains(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.items[id]
+	if !ok {
+		return false
+	}
+	if time.Now().After(e.Value.(lruEntry).expires) {
+		s.order.Remove(e)
+		delete(s.items, id)
+		return false
+	}
+	return true
+}
+
+func (s *lruSet) add(id string, expires time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.items[id]; ok {
+		e.Value = lruEntry{id: id, expires: expires}
+		s.order.MoveToFront(e)
+		return
+	}
+	s.items[id] = s.order.PushFront(lruEntry{id: id, expires: expires})
+	for s.order.Len() > s.size {
+		oldest := s.order.Back()
+		s.order.Remove(oldest)
+		delete(s.items, oldest.Value.(lruEntry).id)
+	}
+}
+
+var dedupeBucket = []byte("dedupe")
+
+// Seen implements DedupeStore, so a client can keep handled message IDs in
+// the same file as its outbox.
+func (o *Outbox) Seen(id string) (bool, error) {
+	var ok bool
+	err := o.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(dedupeBucket)
+		if b == nil {
+			return nil
+		}
+		if v := b.Get([]byte(id)); len(v) == 8 {
+			ok = time.Now().UnixNano() < int64(binary.BigEndian.Uint64(v))
+		}
+		return nil
+	})
+	return ok, err
+}
+
+// Mark implements DedupeStore. Expired IDs are removed now and then while
+// marking.
+func (o *Outbox) Mark(id string, expires time.Time) error {
+	return o.db.Update(func(tx *bolt.Tx) error {
+		return o.mark(tx, id, expires)
+	})
+}
+
+// MarkHandled marks id as handled like Mark, as part of the transaction, so
+// a handler can record a delivery as done together with the state it
+// changed.
+func (tx *OutboxTx) MarkHandled(id string, expires time.Time) error {
+	return tx.outbox.mark(tx.tx, id, expires)
+}
+
+func (o *Outbox) mark(tx *bolt.Tx, id string, expires time.Time) error {
+	b, err := tx.CreateBucketIfNotExists(dedupeBucket)
+	if err != nil {
+		return err
+	}
+	// Only one write transaction runs at a time, so dedupePruned needs no
+	// lock of its own.
+	if now := time.Now(); now.Sub(o.dedupePruned) > time.Minute {
+		o.dedupePruned = now
+		var expired [][]byte
+		b.ForEach(func(k, v []byte) error {
+			if len(v) != 8 || int64(binary.BigEndian.Uint64(v)) <= now.UnixNano() {
+				expired = append(expired, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		for _, k := range expired {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+	}
+	return b.Put([]byte(id), binary.BigEndian.AppendUint64(nil, uint64(expires.UnixNano())))
+}
+
+// WithDerivedMessageID gives a message published while handling a delivery
+// an ID derived from the delivery's message ID and name, so handling a
+// redelivery publishes the same ID again. name tells apart the messages a
+// handler publishes. Outside of a handler it has no effect.
+func WithDerivedMessageID(ctx context.Context, name string) PublishOption {
+	meta, ok := MetadataFromContext(ctx)
+	if !ok || meta.MessageID == "" {
+		return func(*publishOptions) {}
+	}
+	sum := sha256.Sum256([]byte(meta.MessageID + "/" + name))
+	return WithMessageID(hex.EncodeToString(sum[:16]))
+}
@@ -0,0 +1,173 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestDedupe(t *testing.T) {
+	cases := []struct {
+		name string
+		id   string
+		// ack is what the handler returns the first time.
+		ack          AckType
+		handledAgain bool
+	}{
+		{"acked", "war-1", Ack, false},
+		{"requeued", "war-1", NackRequeue, true},
+		{"discarded", "war-1", NackDiscard, true},
+		{"no message ID", "", Ack, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			calls := 0
+			h := Dedupe(10, time.Hour, nil)(func(context.Context, any, Metadata) AckType {
+				calls++
+				if calls == 1 {
+					return c.ack
+				}
+				return Ack
+			})
+			meta := Metadata{MessageID: c.id}
+			if ack := h(context.Background(), nil, meta); ack != c.ack {
+				t.Errorf("first delivery settled with %v, want %v", ack, c.ack)
+			}
+			if ack := h(context.Background(), nil, meta); ack != Ack {
+				t.Errorf("second delivery settled with %v, want Ack", ack)
+			}
+			if got := calls == 2; got != c.handledAgain {
+				t.Errorf("second delivery handled: %v, want %v", got, c.handledAgain)
+			}
+		})
+	}
+}
+
+func TestMarkHandledCommitsWithEnqueue(t *testing.T) {
+	cases := []struct {
+		name string
+		// crashBeforeCommit fails the first handling after it has enqueued
+		// the log; otherwise the process dies once it has committed, before
+		// the delivery is marked by Dedupe or acked.
+		crashBeforeCommit bool
+		// handledAgain reports whether the redelivery reaches the handler.
+		handledAgain bool
+	}{
+		{"crash between commit and ack", false, false},
+		{"crash before commit", true, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "client.outbox")
+			meta := Metadata{MessageID: "war-1"}
+			ctx := contextWithMetadata(context.Background(), meta)
+
+			// handler records the war and its game log the way the client's
+			// war handler does
+			var calls int
+			handler := func(outbox *Outbox, crash bool) Handler {
+				return func(ctx context.Context, _ any, meta Metadata) AckType {
+					calls++
+					err := outbox.Update(func(tx *OutboxTx) error {
+						if err := tx.MarkHandled(meta.MessageID, time.Now().Add(time.Hour)); err != nil {
+							return err
+						}
+						if err := Enqueue(tx, "peril_topic", "game_logs.alice", Envelope[string]{Value: "alice won"}, WithDerivedMessageID(ctx, "log")); err != nil {
+							return err
+						}
+						if crash {
+							return errors.New("crashed")
+						}
+						return nil
+					})
+					if err != nil {
+						return NackRequeue
+					}
+					return Ack
+				}
+			}
+
+			outbox, err := OpenOutbox(path)
+			if err != nil {
+				t.Fatalf("OpenOutbox: %v", err)
+			}
+			// The first delivery never gets back to Dedupe
+			handler(outbox, c.crashBeforeCommit)(ctx, nil, meta)
+			outbox.Close()
+
+			// The restarted process gets the delivery again
+			outbox, err = OpenOutbox(path)
+			if err != nil {
+				t.Fatalf("OpenOutbox: %v", err)
+			}
+			defer outbox.Close()
+			if ack := Dedupe(10, time.Hour, outbox)(handler(outbox, false))(ctx, nil, meta); ack != Ack {
+				t.Errorf("redelivery settled with %v, want Ack", ack)
+			}
+			if got, want := calls == 2, c.handledAgain; got != want {
+				t.Errorf("redelivery handled: %v, want %v", got, want)
+			}
+			if n, err := outbox.Pending(); err != nil || n != 1 {
+				t.Errorf("Pending = %d, %v; want the game log once", n, err)
+			}
+		})
+	}
+}
+
+func TestDedupeAcrossRestart(t *testing.T) {
+	for _, tb := range testBrokers(t) {
+		t.Run(tb.name, func(t *testing.T) {
+			conn := tb.connect(t)
+			exchange := declareTestExchange(t, conn, amqp.ExchangeDirect)
+			pub := newTestPublisher(t, conn)
+			path := filepath.Join(t.TempDir(), "dedupe.outbox")
+			queue := testName("queue")
+			tb.remove(t, queue)
+
+			// run subscribes with a fresh Dedupe and outbox, as a restarted
+			// process would, publishes ids in order and returns the ones
+			// that reached the handler once the last one has.
+			run := func(ids ...string) []string {
+				outbox, err := OpenOutbox(path)
+				if err != nil {
+					t.Fatalf("OpenOutbox: %v", err)
+				}
+				defer outbox.Close()
+				handled := make(chan string, len(ids))
+				sub, err := SubscribeWithMetadata(testContext(t), conn, exchange, queue, "key", SimpleQueueDurable, func(_ context.Context, _ string, meta Metadata) AckType {
+					handled <- meta.MessageID
+					return Ack
+				}, WithMiddleware(Dedupe(100, time.Hour, outbox)))
+				if err != nil {
+					t.Fatalf("Subscribe: %v", err)
+				}
+				defer sub.Close()
+				for _, id := range ids {
+					if err := PublishJSON(context.Background(), pub, exchange, "key", id, WithMessageID(id)); err != nil {
+						t.Fatalf("PublishJSON: %v", err)
+					}
+				}
+				var got []string
+				for {
+					id := receive(t, handled)
+					got = append(got, id)
+					if id == ids[len(ids)-1] {
+						return got
+					}
+				}
+			}
+
+			if got := run("a", "b"); fmt.Sprint(got) != "[a b]" {
+				t.Fatalf("first run handled %v, want [a b]", got)
+			}
+			if got := run("a", "b", "c"); fmt.Sprint(got) != "[c]" {
+				t.Errorf("second run handled %v, want [c]", got)
+			}
+		})
+	}
+}
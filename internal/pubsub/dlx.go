@@ -0,0 +1,66 @@
+package pubsub
+
+import (
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Death is one entry of the x-death header RabbitMQ adds when it
+// dead-letters a message.
+type Death struct {
+	Queue       string
+	Exchange    string
+	Reason      string
+	RoutingKeys []string
+	Count       int64
+	Time        time.Time
+}
+
+// Deaths parses the x-death header, most recent death first.
+func Deaths(headers amqp.Table) []Death {
+	entries, ok := headers["x-death"].([]interface{})
+	if !ok {
+		return nil
+	}
+	deaths := make([]Death, 0, len(entries))
+	for _, entry := range entries {
+		t, ok := entry.(amqp.Table)
+		if !ok {
+			continue
+		}
+		var d Death
+		d.Queue, _ = t["queue"].(string)
+		d.Exchange, _ = t["exchange"].(string)
+		d.Reason, _ = t["reason"].(string)
+		d.Count, _ = t["count"].(int64)
+		d.Time, _ = t["time"].(time.Time)
+		if keys, ok := t["routing-keys"].([]interface{}); ok {
+			for _, k := range keys {
+				if s, ok := k.(string); ok {
+					d.RoutingKeys = append(d.RoutingKeys, s)
+				}
+			}
+		}
+		deaths = append(deaths, d)
+	}
+	return deaths
+}
+
+// Origin returns the exchange and routing key a dead-lettered message was
+// first published with, so it can be sent back there.
+func Origin(headers amqp.Table) (exchange, key string, ok bool) {
+	if key, ok := headers[OriginalRoutingKeyHeader].(string); ok {
+		exchange, _ := headers[OriginalExchangeHeader].(string)
+		return exchange, key, true
+	}
+	deaths := Deaths(headers)
+	if len(deaths) == 0 {
+		return "", "", false
+	}
+	first := deaths[len(deaths)-1]
+	if len(first.RoutingKeys) == 0 {
+		return "", "", false
+	}
+	return first.Exchange, first.RoutingKeys[0], true
+}
@@ -0,0 +1,236 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strconv"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"go.opentelemetry.io/otel/codes"
+)
+
+// SchemaVersionHeader carries the version of the payload schema, so
+// consumers can tell old message shapes from new ones.
+const SchemaVersionHeader = "x-schema-version"
+
+// Envelope is a value together with the metadata it is published with.
+// Empty fields are filled in by PublishEnvelope: MessageID gets a random ID,
+// Timestamp the current time, Type the Go type name of Value and Version 1.
+type Envelope[T any] struct {
+	Value         T
+	MessageID     string
+	Timestamp     time.Time
+	AppID         string
+	Type          string
+	CorrelationID string
+	ReplyTo       string
+	Version       int
+	Headers       amqp.Table
+}
+
+// Metadata describes a delivery received by SubscribeWithMetadata.
+type Metadata struct {
+	MessageID     string
+	Timestamp     time.Time
+	AppID         string
+	Type          string
+	CorrelationID string
+	ReplyTo       string
+	ContentType   string
+	// Version is the schema version the message was published with; messages
+	// from before versioning report 1.
+	Version     int
+	Exchange    string
+	RoutingKey  string
+	Redelivered bool
+	Headers     amqp.Table
+	// Key is the routing key as parsed by WithKeyParser, or nil without
+	// one. A retried message keeps the key it was first published with.
+	Key any
+	// Batch holds the Metadata of every message when a SubscribeBatch
+	// handler is called; the rest of the fields describe the last of them.
+	Batch []Metadata
+}
+
+// metadataFor returns the Metadata of delivery, failing if its routing key
+// cannot be parsed.
+func metadataFor(delivery amqp.Delivery, options subscribeOptions) (Metadata, error) {
+	meta := Metadata{
+		MessageID:     delivery.MessageId,
+		Timestamp:     delivery.Timestamp,
+		AppID:         delivery.AppId,
+		Type:          delivery.Type,
+		CorrelationID: delivery.CorrelationId,
+		ReplyTo:       delivery.ReplyTo,
+		ContentType:   delivery.ContentType,
+		Version:       schemaVersion(delivery.Headers),
+		Exchange:      delivery.Exchange,
+		RoutingKey:    delivery.RoutingKey,
+		Redelivered:   delivery.Redelivered,
+		Headers:       delivery.Headers,
+	}
+	if options.parseKey != nil {
+		key := delivery.RoutingKey
+		if original, ok := delivery.Headers[OriginalRoutingKeyHeader].(string); ok {
+			key = original
+		}
+		parsed, err := options.parseKey(key)
+		if err != nil {
+			return Metadata{}, err
+		}
+		meta.Key = parsed
+	}
+	return meta, nil
+}
+
+type metadataKey struct{}
+
+func contextWithMetadata(ctx context.Context, meta Metadata) context.Context {
+	return context.WithValue(ctx, metadataKey{}, meta)
+}
+
+// MetadataFromContext returns the Metadata of the delivery a handler was
+// called for.
+func MetadataFromContext(ctx context.Context) (Metadata, bool) {
+	meta, ok := ctx.Value(metadataKey{}).(Metadata)
+	return meta, ok
+}
+
+func schemaVersion(headers amqp.Table) int {
+	if v, ok := intArg(headers, SchemaVersionHeader); ok && v > 0 {
+		return int(v)
+	}
+	return 1
+}
+
+// PublishEnvelope encodes env.Value like Publish does and sets the AMQP
+// message properties from the rest of the envelope.
+func PublishEnvelope[T any](ctx context.Context, ch Publisher, exchange, key string, env Envelope[T], opts ...PublishOption) error {
+	msg, err := encode(env, newPublishOptions(opts))
+	if err != nil {
+		return err
+	}
+	return publish(ctx, ch, exchange, key, false, msg)
+}
+
+// encode builds the message for env with the publish options applied.
+func encode[T any](env Envelope[T], options publishOptions) (amqp.Publishing, error) {
+	if options.messageID != "" {
+		env.MessageID = options.messageID
+	}
+	msg, err := env.publishing(options.codec)
+	if err != nil {
+		return msg, err
+	}
+	if options.expiration > 0 {
+		msg.Expiration = strconv.FormatInt(options.expiration.Milliseconds(), 10)
+	}
+	msg.Priority = options.priority
+	return msg, nil
+}
+
+// publishing encodes the envelope with codec, filling in the defaults for
+// empty fields.
+func (env Envelope[T]) publishing(codec Codec) (amqp.Publishing, error) {
+	body, err := codec.Marshal(env.Value)
+	if err != nil {
+		return amqp.Publishing{}, err
+	}
+
+	if env.MessageID == "" {
+		env.MessageID = newMessageID()
+	}
+	if env.Timestamp.IsZero() {
+		env.Timestamp = time.Now()
+	}
+	if env.Type == "" {
+		env.Type = reflect.TypeOf((*T)(nil)).Elem().String()
+	}
+	if env.Version == 0 {
+		env.Version = 1
+	}
+	headers := amqp.Table{}
+	for k, v := range env.Headers {
+		headers[k] = v
+	}
+	headers[SchemaVersionHeader] = int32(env.Version)
+
+	return amqp.Publishing{
+		Headers:       headers,
+		ContentType:   codec.ContentType(),
+		CorrelationId: env.CorrelationID,
+		ReplyTo:       env.ReplyTo,
+		MessageId:     env.MessageID,
+		Timestamp:     env.Timestamp,
+		Type:          env.Type,
+		AppId:         env.AppID,
+		Body:          body,
+	}, nil
+}
+
+// publish sends msg, tracing it and recording it in the publish metrics.
+func publish(ctx context.Context, ch Publisher, exchange, key string, mandatory bool, msg amqp.Publishing) error {
+	if msg.Headers == nil {
+		msg.Headers = amqp.Table{}
+	}
+	ctx, span := startPublishSpan(ctx, exchange, key, msg, msg.Headers)
+	defer span.End()
+	start := time.Now()
+	err := ch.PublishWithContext(ctx, exchange, key, mandatory, false, msg)
+	publishDuration.WithLabelValues(exchange).Observe(time.Since(start).Seconds())
+	publishedTotal.WithLabelValues(exchange, publishOutcome(err)).Inc()
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return err
+}
+
+// upgrader decodes a body of an older schema version and converts it to the
+// subscriber's current type.
+type upgrader func(codec Codec, body []byte) (any, error)
+
+// WithUpgrade lets a subscriber read messages published with schema version
+// from. Such bodies are decoded into Old and passed through fn, which must
+// return the type the subscriber handles.
+func WithUpgrade[Old, New any](from int, fn func(Old) (New, error)) SubscribeOption {
+	return func(o *subscribeOptions) {
+		if o.upgrades == nil {
+			o.upgrades = map[int]upgrader{}
+		}
+		o.upgrades[from] = func(codec Codec, body []byte) (any, error) {
+			var old Old
+			if err := codec.Unmarshal(body, &old); err != nil {
+				return nil, err
+			}
+			return fn(old)
+		}
+	}
+}
+
+// decode unmarshals delivery into a T, upgrading it first if it was
+// published with an older schema version.
+func decode[T any](delivery amqp.Delivery, options subscribeOptions) (T, error) {
+	var v T
+	codec, err := codecForDelivery(delivery.ContentType, options.codec)
+	if err != nil {
+		return v, err
+	}
+	version := schemaVersion(delivery.Headers)
+	up, ok := options.upgrades[version]
+	if !ok {
+		err = codec.Unmarshal(delivery.Body, &v)
+		return v, err
+	}
+	upgraded, err := up(codec, delivery.Body)
+	if err != nil {
+		return v, fmt.Errorf("could not upgrade schema version %d: %w", version, err)
+	}
+	v, ok = upgraded.(T)
+	if !ok {
+		return v, fmt.Errorf("upgrade from schema version %d returned %T, want %T", version, upgraded, v)
+	}
+	return v, nil
+}
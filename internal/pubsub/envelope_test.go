@@ -0,0 +1,156 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// testMoveV1 is the shape testMove had at schema version 1.
+type testMoveV1 struct {
+	Username string
+}
+
+func TestWithUpgrade(t *testing.T) {
+	cases := []struct {
+		name    string
+		publish func(ctx context.Context, pub Publisher, exchange string) error
+		want    testMove
+		// poison reports whether the delivery is dead-lettered instead.
+		poison bool
+	}{
+		{"current version", func(ctx context.Context, pub Publisher, exchange string) error {
+			return PublishEnvelope(ctx, pub, exchange, "army_moves.alice", Envelope[testMove]{Value: testMove{Player: "alice", Units: 2}, Version: 2})
+		}, testMove{Player: "alice", Units: 2}, false},
+		{"upgraded from version 1", func(ctx context.Context, pub Publisher, exchange string) error {
+			return PublishEnvelope(ctx, pub, exchange, "army_moves.alice", Envelope[testMoveV1]{Value: testMoveV1{Username: "alice"}, Version: 1})
+		}, testMove{Player: "alice", Units: 1}, false},
+		{"no version header is version 1", func(ctx context.Context, pub Publisher, exchange string) error {
+			msg := amqp.Publishing{ContentType: JSON.ContentType(), Body: []byte(`{"Username":"alice"}`)}
+			return pub.PublishWithContext(ctx, exchange, "army_moves.alice", true, false, msg)
+		}, testMove{Player: "alice", Units: 1}, false},
+		{"upgrade fails", func(ctx context.Context, pub Publisher, exchange string) error {
+			return PublishEnvelope(ctx, pub, exchange, "army_moves.alice", Envelope[testMoveV1]{Version: 1})
+		}, testMove{}, true},
+	}
+	upgrade := func(old testMoveV1) (testMove, error) {
+		if old.Username == "" {
+			return testMove{}, errors.New("no username")
+		}
+		return testMove{Player: old.Username, Units: 1}, nil
+	}
+	for _, tb := range testBrokers(t) {
+		t.Run(tb.name, func(t *testing.T) {
+			conn := tb.connect(t)
+			exchange := declareTestExchange(t, conn, amqp.ExchangeTopic)
+			pub := newTestPublisher(t, conn)
+			for _, c := range cases {
+				t.Run(c.name, func(t *testing.T) {
+					dlx, dlq := declareDeadLetters(t, tb, conn)
+					moves := make(chan testMove, 1)
+					sub, err := Subscribe(testContext(t), conn, exchange, "", "army_moves.*", SimpleQueueTransient, func(_ context.Context, m testMove) AckType {
+						moves <- m
+						return Ack
+					}, WithUpgrade(1, upgrade), WithQueueOptions(WithDeadLetterExchange(dlx)), WithoutMiddleware())
+					if err != nil {
+						t.Fatalf("Subscribe: %v", err)
+					}
+					defer sub.Close()
+
+					if err := c.publish(context.Background(), pub, exchange); err != nil {
+						t.Fatalf("publish: %v", err)
+					}
+					if c.poison {
+						getMessage(t, conn, dlq)
+						return
+					}
+					if got := receive(t, moves); got != c.want {
+						t.Errorf("handler got %+v, want %+v", got, c.want)
+					}
+				})
+			}
+		})
+	}
+}
+
+func TestEnvelopeMetadata(t *testing.T) {
+	sent := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	cases := []struct {
+		name string
+		env  Envelope[testMove]
+		// check reports what is wrong with meta, if anything.
+		check func(meta Metadata) string
+	}{
+		{"defaults", Envelope[testMove]{}, func(meta Metadata) string {
+			switch {
+			case meta.MessageID == "":
+				return "want a generated MessageID"
+			case meta.Timestamp.IsZero():
+				return "want a Timestamp"
+			case meta.Type != "pubsub.testMove":
+				return "want Type pubsub.testMove"
+			case meta.Version != 1:
+				return "want Version 1"
+			case meta.ContentType != JSON.ContentType():
+				return "want the JSON content type"
+			}
+			return ""
+		}},
+		{"set by the publisher", Envelope[testMove]{
+			MessageID:     "move-1",
+			Timestamp:     sent,
+			AppID:         "peril",
+			Type:          "move",
+			CorrelationID: "corr-1",
+			ReplyTo:       "replies",
+			Version:       3,
+			Headers:       amqp.Table{"x-player": "alice"},
+		}, func(meta Metadata) string {
+			switch {
+			case meta.MessageID != "move-1" || meta.AppID != "peril" || meta.Type != "move":
+				return "want the published MessageID, AppID and Type"
+			case meta.CorrelationID != "corr-1" || meta.ReplyTo != "replies":
+				return "want the published CorrelationID and ReplyTo"
+			case !meta.Timestamp.Equal(sent):
+				return "want the published Timestamp"
+			case meta.Version != 3:
+				return "want Version 3"
+			case meta.Headers["x-player"] != "alice":
+				return "want the published headers"
+			case meta.Exchange == "" || meta.RoutingKey != "army_moves.alice":
+				return "want the exchange and routing key"
+			}
+			return ""
+		}},
+	}
+	for _, tb := range testBrokers(t) {
+		t.Run(tb.name, func(t *testing.T) {
+			conn := tb.connect(t)
+			exchange := declareTestExchange(t, conn, amqp.ExchangeTopic)
+			pub := newTestPublisher(t, conn)
+			for _, c := range cases {
+				t.Run(c.name, func(t *testing.T) {
+					metas := make(chan Metadata, 1)
+					sub, err := SubscribeWithMetadata(testContext(t), conn, exchange, "", "army_moves.*", SimpleQueueTransient, func(_ context.Context, _ testMove, meta Metadata) AckType {
+						metas <- meta
+						return Ack
+					}, WithoutMiddleware())
+					if err != nil {
+						t.Fatalf("Subscribe: %v", err)
+					}
+					defer sub.Close()
+					if err := PublishEnvelope(context.Background(), pub, exchange, "army_moves.alice", c.env); err != nil {
+						t.Fatalf("PublishEnvelope: %v", err)
+					}
+					meta := receive(t, metas)
+					if problem := c.check(meta); problem != "" {
+						t.Errorf("Metadata = %+v, %s", meta, problem)
+					}
+				})
+			}
+		})
+	}
+}
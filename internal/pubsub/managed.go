@@ -0,0 +1,854 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// ErrDisconnected is returned by a managed broker's channels while the
+// underlying connection is down and being re-established.
+var ErrDisconnected = errors.New("pubsub: not connected to broker")
+
+// DialFunc opens a fresh connection to the broker.
+type DialFunc func() (Broker, error)
+
+// ManagedOption configures a ManagedBroker.
+type ManagedOption func(*ManagedBroker)
+
+// WithBackoff sets the delay before the first reconnect attempt and the cap
+// it doubles up to on each subsequent failure.
+func WithBackoff(initial, max time.Duration) ManagedOption {
+	return func(b *ManagedBroker) {
+		b.minBackoff = initial
+		b.maxBackoff = max
+	}
+}
+
+// ManagedBroker is a Broker that survives connection loss. It watches the
+// connection, reconnects with exponential backoff and then re-declares every
+// exchange, queue and binding made through its channels, re-applies QoS and
+// restarts every consumer so that delivery channels handed out earlier keep
+// receiving messages.
+type ManagedBroker struct {
+	dial       DialFunc
+	minBackoff time.Duration
+	maxBackoff time.Duration
+
+	mu       sync.Mutex
+	conn     Broker
+	ready    chan struct{}
+	topology topology
+	channels map[*managedChannel]struct{}
+	closes   []chan *amqp.Error
+	closed   bool
+	done     chan struct{}
+	seq      uint64
+}
+
+var _ Broker = (*ManagedBroker)(nil)
+
+// DialManaged connects to the RabbitMQ server at url and keeps the connection
+// alive for the lifetime of the returned broker.
+func DialManaged(url string, opts ...ManagedOption) (*ManagedBroker, error) {
+	return NewManagedBroker(func() (Broker, error) {
+		conn, err := amqp.Dial(url)
+		if err != nil {
+			return nil, err
+		}
+		return NewAMQPBroker(conn), nil
+	}, opts...)
+}
+
+// NewManagedBroker makes the first connection with dial and uses it again for
+// every reconnect. Only the first connection failure is returned; later ones
+// are retried until Close is called.
+func NewManagedBroker(dial DialFunc, opts ...ManagedOption) (*ManagedBroker, error) {
+	b := &ManagedBroker{
+		dial:       dial,
+		minBackoff: 500 * time.Millisecond,
+		maxBackoff: 30 * time.Second,
+		ready:      make(chan struct{}),
+		channels:   map[*managedChannel]struct{}{},
+		done:       make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	conn, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	b.conn = conn
+	close(b.ready)
+	go b.watch(conn)
+	return b, nil
+}
+
+func (b *ManagedBroker) Channel() (Channel, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil, amqp.ErrClosed
+	}
+	if b.conn == nil {
+		return nil, ErrDisconnected
+	}
+	ch, err := b.conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+	mc := &managedChannel{
+		broker:      b,
+		consumers:   map[string]*managedConsumer{},
+		outstanding: map[uint64]uint64{},
+		done:        make(chan struct{}),
+	}
+	mc.mu.Lock()
+	mc.attach(ch)
+	mc.mu.Unlock()
+	b.channels[mc] = struct{}{}
+	return mc, nil
+}
+
+// NotifyClose registers a listener that is closed when the managed broker is
+// closed. Connection losses that are recovered from are not reported.
+func (b *ManagedBroker) NotifyClose(receiver chan *amqp.Error) chan *amqp.Error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		close(receiver)
+		return receiver
+	}
+	b.closes = append(b.closes, receiver)
+	return receiver
+}
+
+// Close stops reconnecting and closes every channel and the connection.
+func (b *ManagedBroker) Close() error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return amqp.ErrClosed
+	}
+	b.closed = true
+	close(b.done)
+	channels := make([]*managedChannel, 0, len(b.channels))
+	for mc := range b.channels {
+		channels = append(channels, mc)
+	}
+	conn := b.conn
+	notifyClosed(b.closes, nil)
+	b.closes = nil
+	b.mu.Unlock()
+
+	for _, mc := range channels {
+		mc.Close()
+	}
+	if conn != nil {
+		return conn.Close()
+	}
+	return nil
+}
+
+// waitReady blocks until the broker is connected, ctx is done or the broker
+// is closed.
+func (b *ManagedBroker) waitReady(ctx context.Context) error {
+	b.mu.Lock()
+	ready := b.ready
+	b.mu.Unlock()
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-b.done:
+		return amqp.ErrClosed
+	}
+}
+
+func (b *ManagedBroker) watch(conn Broker) {
+	notify := conn.NotifyClose(make(chan *amqp.Error, 1))
+	select {
+	case err := <-notify:
+		b.mu.Lock()
+		if b.closed {
+			b.mu.Unlock()
+			return
+		}
+		b.conn = nil
+		b.ready = make(chan struct{})
+		for mc := range b.channels {
+			mc.detach()
+		}
+		b.mu.Unlock()
+		log.Printf("pubsub: connection lost: %v", err)
+		b.reconnect()
+	case <-b.done:
+	}
+}
+
+func (b *ManagedBroker) reconnect() {
+	delay := b.minBackoff
+	for attempt := 1; ; attempt++ {
+		conn, err := b.dial()
+		if err == nil {
+			b.mu.Lock()
+			if b.closed {
+				b.mu.Unlock()
+				conn.Close()
+				return
+			}
+			err = b.restore(conn)
+			if err == nil {
+				b.conn = conn
+				close(b.ready)
+				b.mu.Unlock()
+				log.Printf("pubsub: reconnected after %d attempt(s)", attempt)
+				go b.watch(conn)
+				return
+			}
+			for mc := range b.channels {
+				mc.detach()
+			}
+			b.mu.Unlock()
+			conn.Close()
+		}
+		log.Printf("pubsub: reconnect attempt %d failed: %v; retrying in %s", attempt, err, delay)
+		select {
+		case <-time.After(delay):
+		case <-b.done:
+			return
+		}
+		delay *= 2
+		if delay > b.maxBackoff {
+			delay = b.maxBackoff
+		}
+	}
+}
+
+// restore replays the recorded topology on conn and reopens every channel.
+// It must be called with b.mu held.
+func (b *ManagedBroker) restore(conn Broker) error {
+	setup, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	if err := b.topology.apply(setup); err != nil {
+		setup.Close()
+		return err
+	}
+	setup.Close()
+	for mc := range b.channels {
+		if err := mc.reopen(conn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reopenChannel replaces a channel the broker closed with cause while the
+// connection stayed up, e.g. after a failed declaration. If no replacement
+// can be opened, mc is closed and reports cause to its NotifyClose
+// listeners.
+func (b *ManagedBroker) reopenChannel(mc *managedChannel, dead Channel, cause *amqp.Error) {
+	b.mu.Lock()
+	if b.closed || b.conn == nil || !mc.isCurrent(dead) {
+		b.mu.Unlock()
+		return
+	}
+	err := mc.reopen(b.conn)
+	b.mu.Unlock()
+	// A closed connection is left to watch, which restores every channel.
+	if err == nil || errors.Is(err, amqp.ErrClosed) {
+		return
+	}
+	log.Printf("pubsub: could not reopen channel: %v; closing it", err)
+	mc.close(cause)
+}
+
+func (b *ManagedBroker) forget(mc *managedChannel) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.channels, mc)
+}
+
+func (b *ManagedBroker) nextConsumerTag() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.seq++
+	return fmt.Sprintf("ctag-managed-%d", b.seq)
+}
+
+type exchangeDecl struct {
+	name       string
+	kind       string
+	durable    bool
+	autoDelete bool
+	internal   bool
+	args       amqp.Table
+}
+
+type queueDecl struct {
+	name       string
+	durable    bool
+	autoDelete bool
+	exclusive  bool
+	args       amqp.Table
+}
+
+type bindingDecl struct {
+	queue    string
+	key      string
+	exchange string
+	args     amqp.Table
+}
+
+// topology records declarations in the order they were first made so they
+// can be replayed after a reconnect.
+type topology struct {
+	exchanges []exchangeDecl
+	queues    []queueDecl
+	bindings  []bindingDecl
+}
+
+func (t *topology) addExchange(d exchangeDecl) {
+	for i, e := range t.exchanges {
+		if e.name == d.name {
+			t.exchanges[i] = d
+			return
+		}
+	}
+	t.exchanges = append(t.exchanges, d)
+}
+
+func (t *topology) addQueue(d queueDecl) {
+	for i, q := range t.queues {
+		if q.name == d.name {
+			t.queues[i] = d
+			return
+		}
+	}
+	t.queues = append(t.queues, d)
+}
+
+func (t *topology) addBinding(d bindingDecl) {
+	for _, bnd := range t.bindings {
+		if bnd.queue == d.queue && bnd.key == d.key && bnd.exchange == d.exchange {
+			return
+		}
+	}
+	t.bindings = append(t.bindings, d)
+}
+
+func (t *topology) apply(ch Channel) error {
+	for _, d := range t.exchanges {
+		if err := ch.ExchangeDeclare(d.name, d.kind, d.durable, d.autoDelete, d.internal, false, d.args); err != nil {
+			return fmt.Errorf("could not redeclare exchange %q: %w", d.name, err)
+		}
+	}
+	for _, d := range t.queues {
+		if _, err := ch.QueueDeclare(d.name, d.durable, d.autoDelete, d.exclusive, false, d.args); err != nil {
+			return fmt.Errorf("could not redeclare queue %q: %w", d.name, err)
+		}
+	}
+	for _, d := range t.bindings {
+		if err := ch.QueueBind(d.queue, d.key, d.exchange, false, d.args); err != nil {
+			return fmt.Errorf("could not rebind queue %q: %w", d.queue, err)
+		}
+	}
+	return nil
+}
+
+// managedChannel is the Channel handed out by a ManagedBroker. Its underlying
+// channel is swapped out on reconnect; consumers keep their delivery channel.
+type managedChannel struct {
+	broker *ManagedBroker
+
+	mu           sync.Mutex
+	ch           Channel
+	qosSet       bool
+	prefetch     int
+	prefetchSize int
+	global       bool
+	consumers    map[string]*managedConsumer
+	confirm      bool
+	published    uint64
+	base         uint64
+	outstanding  map[uint64]uint64
+	returns      []chan amqp.Return
+	confirms     []chan amqp.Confirmation
+	notifiers    sync.WaitGroup
+	closes       []chan *amqp.Error
+	closed       bool
+	done         chan struct{}
+}
+
+type managedConsumer struct {
+	queue      string
+	tag        string
+	autoAck    bool
+	exclusive  bool
+	noLocal    bool
+	args       amqp.Table
+	out        chan amqp.Delivery
+	stop       chan struct{}
+	stopped    bool
+	forwarding int
+}
+
+var _ Channel = (*managedChannel)(nil)
+
+func (mc *managedChannel) current() (Channel, error) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	if mc.closed {
+		return nil, amqp.ErrClosed
+	}
+	if mc.ch == nil {
+		return nil, ErrDisconnected
+	}
+	return mc.ch, nil
+}
+
+func (mc *managedChannel) isCurrent(ch Channel) bool {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	return !mc.closed && mc.ch == ch
+}
+
+func (mc *managedChannel) detach() {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	mc.ch = nil
+}
+
+// reopen opens a replacement channel on conn and restarts QoS and consumers
+// on it.
+func (mc *managedChannel) reopen(conn Broker) error {
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	if mc.closed {
+		ch.Close()
+		return nil
+	}
+	if mc.qosSet {
+		if err := ch.Qos(mc.prefetch, mc.prefetchSize, mc.global); err != nil {
+			ch.Close()
+			return err
+		}
+	}
+	if mc.confirm {
+		if err := ch.Confirm(false); err != nil {
+			ch.Close()
+			return err
+		}
+	}
+	for _, c := range mc.consumers {
+		if c.stopped {
+			continue
+		}
+		deliveries, err := ch.Consume(c.queue, c.tag, c.autoAck, c.exclusive, c.noLocal, false, c.args)
+		if err != nil {
+			ch.Close()
+			return fmt.Errorf("could not restart consumer on %q: %w", c.queue, err)
+		}
+		c.forwarding++
+		go mc.forward(c, deliveries)
+	}
+	mc.attach(ch)
+	return nil
+}
+
+// attach makes ch the current channel. Publisher confirms are renumbered so
+// delivery tags keep increasing across channels, and publishes still awaiting
+// a confirm when ch closes are reported as nacked. It must be called with
+// mc.mu held.
+func (mc *managedChannel) attach(ch Channel) {
+	mc.ch = ch
+	mc.base = mc.published
+	returns := ch.NotifyReturn(make(chan amqp.Return, 16))
+	confirms := ch.NotifyPublish(make(chan amqp.Confirmation, 16))
+	mc.notifiers.Add(1)
+	go mc.notify(mc.base, returns, confirms)
+	// The listener is registered before returning, so a channel that dies
+	// straight away is still reopened.
+	go mc.watch(ch, ch.NotifyClose(make(chan *amqp.Error, 1)))
+}
+
+func (mc *managedChannel) notify(base uint64, returns <-chan amqp.Return, confirms <-chan amqp.Confirmation) {
+	defer mc.notifiers.Done()
+	for returns != nil || confirms != nil {
+		select {
+		case r, ok := <-returns:
+			if !ok {
+				returns = nil
+				continue
+			}
+			mc.emitReturn(r)
+		case c, ok := <-confirms:
+			if !ok {
+				confirms = nil
+				continue
+			}
+			// A return always precedes the confirm of the same publish.
+			for drained := false; !drained && returns != nil; {
+				select {
+				case r, ok := <-returns:
+					if !ok {
+						returns = nil
+						continue
+					}
+					mc.emitReturn(r)
+				default:
+					drained = true
+				}
+			}
+			mc.emitConfirm(amqp.Confirmation{DeliveryTag: base + c.DeliveryTag, Ack: c.Ack})
+		}
+	}
+
+	mc.mu.Lock()
+	var lost []uint64
+	for tag, gen := range mc.outstanding {
+		if gen == base {
+			lost = append(lost, tag)
+		}
+	}
+	mc.mu.Unlock()
+	sort.Slice(lost, func(i, j int) bool { return lost[i] < lost[j] })
+	for _, tag := range lost {
+		mc.emitConfirm(amqp.Confirmation{DeliveryTag: tag, Ack: false})
+	}
+}
+
+func (mc *managedChannel) emitReturn(r amqp.Return) {
+	mc.mu.Lock()
+	listeners := append([]chan amqp.Return(nil), mc.returns...)
+	mc.mu.Unlock()
+	for _, l := range listeners {
+		select {
+		case l <- r:
+		case <-mc.done:
+		}
+	}
+}
+
+func (mc *managedChannel) emitConfirm(c amqp.Confirmation) {
+	mc.mu.Lock()
+	delete(mc.outstanding, c.DeliveryTag)
+	listeners := append([]chan amqp.Confirmation(nil), mc.confirms...)
+	mc.mu.Unlock()
+	for _, l := range listeners {
+		select {
+		case l <- c:
+		case <-mc.done:
+		}
+	}
+}
+
+func (mc *managedChannel) watch(ch Channel, closes <-chan *amqp.Error) {
+	err, ok := <-closes
+	if !ok || err == nil {
+		return
+	}
+	mc.broker.reopenChannel(mc, ch, err)
+}
+
+func (mc *managedChannel) forward(c *managedConsumer, deliveries <-chan amqp.Delivery) {
+	for d := range deliveries {
+		select {
+		case c.out <- d:
+		case <-c.stop:
+		}
+	}
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	c.forwarding--
+	if c.stopped && c.forwarding == 0 {
+		close(c.out)
+	}
+}
+
+// PublishWithContext waits for a reconnect in progress rather than failing.
+func (mc *managedChannel) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	for {
+		mc.mu.Lock()
+		if mc.closed {
+			mc.mu.Unlock()
+			return amqp.ErrClosed
+		}
+		ch := mc.ch
+		if ch == nil {
+			mc.mu.Unlock()
+			if err := mc.broker.waitReady(ctx); err != nil {
+				return err
+			}
+			continue
+		}
+		if !mc.confirm {
+			mc.mu.Unlock()
+			return ch.PublishWithContext(ctx, exchange, key, mandatory, immediate, msg)
+		}
+		// In confirm mode the lock is held across the publish so the
+		// delivery tag count cannot race with a channel being replaced.
+		defer mc.mu.Unlock()
+		if err := ch.PublishWithContext(ctx, exchange, key, mandatory, immediate, msg); err != nil {
+			return err
+		}
+		// Each publish is recorded under the base of the channel that
+		// carried it, so all of them are nacked if that channel dies.
+		mc.published++
+		mc.outstanding[mc.published] = mc.base
+		return nil
+	}
+}
+
+func (mc *managedChannel) Confirm(noWait bool) error {
+	ch, err := mc.current()
+	if err != nil {
+		return err
+	}
+	if err := ch.Confirm(noWait); err != nil {
+		return err
+	}
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	mc.confirm = true
+	return nil
+}
+
+func (mc *managedChannel) NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	if mc.closed {
+		close(confirm)
+		return confirm
+	}
+	mc.confirms = append(mc.confirms, confirm)
+	return confirm
+}
+
+func (mc *managedChannel) NotifyReturn(c chan amqp.Return) chan amqp.Return {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	if mc.closed {
+		close(c)
+		return c
+	}
+	mc.returns = append(mc.returns, c)
+	return c
+}
+
+func (mc *managedChannel) ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error {
+	ch, err := mc.current()
+	if err != nil {
+		return err
+	}
+	if err := ch.ExchangeDeclare(name, kind, durable, autoDelete, internal, noWait, args); err != nil {
+		return err
+	}
+	mc.broker.mu.Lock()
+	defer mc.broker.mu.Unlock()
+	mc.broker.topology.addExchange(exchangeDecl{name, kind, durable, autoDelete, internal, args})
+	return nil
+}
+
+// QueueDeclare declares the queue and records it for replay. Queues with
+// server-generated names are not recorded since they cannot be redeclared
+// under the same name.
+func (mc *managedChannel) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	ch, err := mc.current()
+	if err != nil {
+		return amqp.Queue{}, err
+	}
+	queue, err := ch.QueueDeclare(name, durable, autoDelete, exclusive, noWait, args)
+	if err != nil {
+		return amqp.Queue{}, err
+	}
+	if name != "" {
+		mc.broker.mu.Lock()
+		defer mc.broker.mu.Unlock()
+		mc.broker.topology.addQueue(queueDecl{name, durable, autoDelete, exclusive, args})
+	}
+	return queue, nil
+}
+
+func (mc *managedChannel) QueueDeclarePassive(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	ch, err := mc.current()
+	if err != nil {
+		return amqp.Queue{}, err
+	}
+	return ch.QueueDeclarePassive(name, durable, autoDelete, exclusive, noWait, args)
+}
+
+func (mc *managedChannel) QueuePurge(name string, noWait bool) (int, error) {
+	ch, err := mc.current()
+	if err != nil {
+		return 0, err
+	}
+	return ch.QueuePurge(name, noWait)
+}
+
+func (mc *managedChannel) Get(queue string, autoAck bool) (amqp.Delivery, bool, error) {
+	ch, err := mc.current()
+	if err != nil {
+		return amqp.Delivery{}, false, err
+	}
+	return ch.Get(queue, autoAck)
+}
+
+func (mc *managedChannel) QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error {
+	ch, err := mc.current()
+	if err != nil {
+		return err
+	}
+	if err := ch.QueueBind(name, key, exchange, noWait, args); err != nil {
+		return err
+	}
+	mc.broker.mu.Lock()
+	defer mc.broker.mu.Unlock()
+	mc.broker.topology.addBinding(bindingDecl{name, key, exchange, args})
+	return nil
+}
+
+func (mc *managedChannel) Qos(prefetchCount, prefetchSize int, global bool) error {
+	ch, err := mc.current()
+	if err != nil {
+		return err
+	}
+	if err := ch.Qos(prefetchCount, prefetchSize, global); err != nil {
+		return err
+	}
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	mc.qosSet = true
+	mc.prefetch = prefetchCount
+	mc.prefetchSize = prefetchSize
+	mc.global = global
+	return nil
+}
+
+// Consume starts a consumer whose delivery channel stays open across
+// reconnects. A consumer tag is generated when none is given so the consumer
+// can be restarted under the same tag.
+func (mc *managedChannel) Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error) {
+	ch, err := mc.current()
+	if err != nil {
+		return nil, err
+	}
+	if consumer == "" {
+		consumer = mc.broker.nextConsumerTag()
+	}
+	deliveries, err := ch.Consume(queue, consumer, autoAck, exclusive, noLocal, noWait, args)
+	if err != nil {
+		return nil, err
+	}
+	c := &managedConsumer{
+		queue:      queue,
+		tag:        consumer,
+		autoAck:    autoAck,
+		exclusive:  exclusive,
+		noLocal:    noLocal,
+		args:       args,
+		out:        make(chan amqp.Delivery),
+		stop:       make(chan struct{}),
+		forwarding: 1,
+	}
+	mc.mu.Lock()
+	mc.consumers[consumer] = c
+	mc.mu.Unlock()
+	go mc.forward(c, deliveries)
+	return c.out, nil
+}
+
+// Cancel stops the consumer so it is not restarted on reconnect. Deliveries
+// already received are still forwarded before its delivery channel closes.
+func (mc *managedChannel) Cancel(consumer string, noWait bool) error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	if mc.closed {
+		return amqp.ErrClosed
+	}
+	c, ok := mc.consumers[consumer]
+	if !ok || c.stopped {
+		return nil
+	}
+	c.stopped = true
+	if c.forwarding == 0 {
+		close(c.out)
+	}
+	if mc.ch == nil {
+		return nil
+	}
+	return mc.ch.Cancel(consumer, noWait)
+}
+
+// NotifyClose registers a listener that is closed when the channel is closed.
+// A channel the broker closed is replaced without being reported, unless no
+// replacement could be opened; the broker's error is then sent first.
+func (mc *managedChannel) NotifyClose(receiver chan *amqp.Error) chan *amqp.Error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	if mc.closed {
+		close(receiver)
+		return receiver
+	}
+	mc.closes = append(mc.closes, receiver)
+	return receiver
+}
+
+func (mc *managedChannel) Close() error {
+	return mc.close(nil)
+}
+
+// close closes the channel, sending reason to the NotifyClose listeners if it
+// is not nil.
+func (mc *managedChannel) close(reason *amqp.Error) error {
+	mc.mu.Lock()
+	if mc.closed {
+		mc.mu.Unlock()
+		return amqp.ErrClosed
+	}
+	mc.closed = true
+	for _, c := range mc.consumers {
+		if !c.stopped && c.forwarding == 0 {
+			close(c.out)
+		}
+		c.stopped = true
+		close(c.stop)
+	}
+	ch := mc.ch
+	mc.ch = nil
+	close(mc.done)
+	notifyClosed(mc.closes, reason)
+	mc.closes = nil
+	mc.mu.Unlock()
+
+	mc.broker.forget(mc)
+	var err error
+	if ch != nil {
+		err = ch.Close()
+	}
+	mc.notifiers.Wait()
+	mc.mu.Lock()
+	for _, c := range mc.returns {
+		close(c)
+	}
+	for _, c := range mc.confirms {
+		close(c)
+	}
+	mc.returns, mc.confirms = nil, nil
+	mc.mu.Unlock()
+	return err
+}
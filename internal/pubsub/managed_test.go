@@ -0,0 +1,208 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestManagedBrokerReplaysTopology(t *testing.T) {
+	cases := []struct {
+		name      string
+		queueType SimpleQueueType
+	}{
+		{"transient queue", SimpleQueueTransient},
+		{"durable queue", SimpleQueueDurable},
+	}
+	for _, tb := range testBrokers(t) {
+		t.Run(tb.name, func(t *testing.T) {
+			if tb.restart == nil {
+				t.Skip("the broker cannot be restarted from a test")
+			}
+			for _, c := range cases {
+				t.Run(c.name, func(t *testing.T) {
+					broker, err := NewManagedBroker(func() (Broker, error) {
+						return tb.connect(t), nil
+					}, WithBackoff(10*time.Millisecond, 50*time.Millisecond))
+					if err != nil {
+						t.Fatalf("NewManagedBroker: %v", err)
+					}
+					defer broker.Close()
+
+					// A transient exchange and queue are gone after the
+					// restart; only the replay brings them back
+					exchange := declareTestExchange(t, broker, amqp.ExchangeTopic)
+					queue := testName("queue")
+					tb.remove(t, queue)
+					received := make(chan string, 2)
+					sub, err := Subscribe(testContext(t), broker, exchange, queue, "war.*", c.queueType, func(_ context.Context, s string) AckType {
+						received <- s
+						return Ack
+					}, WithoutMiddleware())
+					if err != nil {
+						t.Fatalf("Subscribe: %v", err)
+					}
+					defer sub.Close()
+					ch, err := broker.Channel()
+					if err != nil {
+						t.Fatalf("Channel: %v", err)
+					}
+					defer ch.Close()
+
+					if err := PublishJSON(context.Background(), ch, exchange, "war.alice", "before"); err != nil {
+						t.Fatalf("PublishJSON: %v", err)
+					}
+					if got := receive(t, received); got != "before" {
+						t.Fatalf("got %q, want %q", got, "before")
+					}
+
+					// Publishes fail, or are not routed, until the topology
+					// has been declared again
+					tb.restart()
+					eventually(t, "a message is received after the restart", func() bool {
+						if err := PublishJSON(context.Background(), ch, exchange, "war.alice", "after"); err != nil {
+							return false
+						}
+						select {
+						case got := <-received:
+							return got == "after"
+						case <-time.After(50 * time.Millisecond):
+							return false
+						}
+					})
+				})
+			}
+		})
+	}
+}
+
+// heldConfirms is a MemoryConn whose channels never deliver their publisher
+// confirms, so publishes stay in flight until the channel dies.
+type heldConfirms struct {
+	*MemoryConn
+	mu     sync.Mutex
+	opened *memChannel
+}
+
+func (c *heldConfirms) Channel() (Channel, error) {
+	ch, err := c.MemoryConn.Channel()
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.opened = ch.(*memChannel)
+	return heldConfirmsChannel{ch}, nil
+}
+
+// last returns the channel opened last.
+func (c *heldConfirms) last() *memChannel {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.opened
+}
+
+// killChannel closes ch as the broker would after a channel error.
+func killChannel(ch *memChannel) {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ch.close(&amqp.Error{Code: amqp.PreconditionFailed, Reason: "PRECONDITION_FAILED", Server: true})
+}
+
+type heldConfirmsChannel struct {
+	Channel
+}
+
+func (ch heldConfirmsChannel) NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation {
+	held := ch.Channel.NotifyPublish(make(chan amqp.Confirmation, 16))
+	go func() {
+		for range held {
+		}
+		close(confirm)
+	}()
+	return confirm
+}
+
+func TestManagedChannelNacksPublishesOnDeadChannel(t *testing.T) {
+	cases := []struct {
+		name string
+		// before is the number of publishes confirmed on an earlier channel.
+		before   int
+		inFlight int
+	}{
+		{"one publish", 0, 1},
+		{"several publishes", 0, 5},
+		{"after a reopened channel", 3, 5},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			mem := NewMemoryBroker()
+			conn := &heldConfirms{MemoryConn: mem.Connect()}
+			defer conn.Close()
+			broker, err := NewManagedBroker(func() (Broker, error) {
+				return conn, nil
+			}, WithBackoff(10*time.Millisecond, 50*time.Millisecond))
+			if err != nil {
+				t.Fatalf("NewManagedBroker: %v", err)
+			}
+			defer broker.Close()
+			exchange := declareTestExchange(t, broker, amqp.ExchangeFanout)
+			ch, err := broker.Channel()
+			if err != nil {
+				t.Fatalf("Channel: %v", err)
+			}
+			defer ch.Close()
+			// The publisher's timeout is long enough that only the nacks of
+			// the dead channel can end the waits below
+			pub, err := NewConfirmingPublisher(ch, time.Minute)
+			if err != nil {
+				t.Fatalf("NewConfirmingPublisher: %v", err)
+			}
+
+			publish := func(n int) []*DeferredConfirm {
+				var deferred []*DeferredConfirm
+				for i := 0; i < n; i++ {
+					d, err := pub.PublishDeferred(context.Background(), exchange, "", amqp.Publishing{Body: []byte("hello")})
+					if err != nil {
+						t.Fatalf("PublishDeferred: %v", err)
+					}
+					deferred = append(deferred, d)
+				}
+				return deferred
+			}
+			wait := func(deferred []*DeferredConfirm) {
+				ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+				defer cancel()
+				for i, d := range deferred {
+					if err := d.Wait(ctx); !errors.Is(err, ErrNacked) {
+						t.Errorf("publish %d = %v, want ErrNacked", i, err)
+					}
+				}
+			}
+			if c.before > 0 {
+				earlier := publish(c.before)
+				killed := conn.last()
+				killChannel(killed)
+				wait(earlier)
+				eventually(t, "the channel is reopened", func() bool {
+					opened := conn.last()
+					return opened != killed && ch.(*managedChannel).isCurrent(heldConfirmsChannel{opened})
+				})
+			}
+
+			deferred := publish(c.inFlight)
+			killChannel(conn.last())
+			wait(deferred)
+			pub.pendingMu.Lock()
+			defer pub.pendingMu.Unlock()
+			if n := len(pub.pending); n != 0 {
+				t.Errorf("%d publishes still pending, want none", n)
+			}
+		})
+	}
+}
@@ -0,0 +1,1128 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// MemoryBroker is an in-process stand-in for RabbitMQ. It implements direct,
+// topic and fanout exchanges, durable and transient queues, prefetch,
+// ack/nack/requeue, message TTL, dead-lettering, length limits, priorities
+// and the delivery limit of quorum queues, so code written against Broker can
+// run without a live server. Streams are not supported.
+type MemoryBroker struct {
+	mu        sync.Mutex
+	cond      *sync.Cond
+	exchanges map[string]*memExchange
+	queues    map[string]*memQueue
+	conns     map[*MemoryConn]struct{}
+	seq       uint64
+}
+
+type memExchange struct {
+	name       string
+	kind       string
+	durable    bool
+	autoDelete bool
+	internal   bool
+	bindings   []memBinding
+}
+
+type memBinding struct {
+	queue string
+	key   string
+}
+
+type memQueue struct {
+	name        string
+	durable     bool
+	autoDelete  bool
+	exclusive   bool
+	owner       *MemoryConn
+	args        amqp.Table
+	messages    []*memMessage
+	consumers   map[*memConsumer]struct{}
+	hadConsumer bool
+}
+
+type memMessage struct {
+	exchange    string
+	key         string
+	pub         amqp.Publishing
+	redelivered bool
+	expires     time.Time
+	// returns counts how often a quorum queue got the message back.
+	returns int
+}
+
+// NewMemoryBroker returns an empty broker with the amq.* exchanges declared.
+func NewMemoryBroker() *MemoryBroker {
+	b := &MemoryBroker{
+		exchanges: map[string]*memExchange{},
+		queues:    map[string]*memQueue{},
+		conns:     map[*MemoryConn]struct{}{},
+	}
+	b.cond = sync.NewCond(&b.mu)
+	for name, kind := range map[string]string{
+		"":            amqp.ExchangeDirect,
+		"amq.direct":  amqp.ExchangeDirect,
+		"amq.topic":   amqp.ExchangeTopic,
+		"amq.fanout":  amqp.ExchangeFanout,
+		"amq.headers": amqp.ExchangeHeaders,
+	} {
+		b.exchanges[name] = &memExchange{name: name, kind: kind, durable: true}
+	}
+	return b
+}
+
+// Connect opens a new connection to the broker. Exclusive queues belong to
+// the connection that declared them and are deleted when it closes.
+func (b *MemoryBroker) Connect() *MemoryConn {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	conn := &MemoryConn{broker: b, channels: map[*memChannel]struct{}{}}
+	b.conns[conn] = struct{}{}
+	return conn
+}
+
+// Restart simulates a broker restart: every connection is dropped, transient
+// queues and exchanges disappear and durable queues keep only their
+// persistent messages.
+func (b *MemoryBroker) Restart() {
+	b.mu.Lock()
+	conns := make([]*MemoryConn, 0, len(b.conns))
+	for conn := range b.conns {
+		conns = append(conns, conn)
+	}
+	b.mu.Unlock()
+	for _, conn := range conns {
+		conn.shutdown(&amqp.Error{Code: amqp.ConnectionForced, Reason: "CONNECTION_FORCED - broker forced connection closure with reason 'shutdown'", Server: true})
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for name, q := range b.queues {
+		if !q.durable {
+			b.deleteQueue(name)
+			continue
+		}
+		kept := q.messages[:0]
+		for _, msg := range q.messages {
+			if msg.pub.DeliveryMode == amqp.Persistent {
+				kept = append(kept, msg)
+			}
+		}
+		q.messages = kept
+	}
+	for name, ex := range b.exchanges {
+		if !ex.durable {
+			delete(b.exchanges, name)
+		}
+	}
+}
+
+// QueueLen reports the number of ready (undelivered) messages in a queue.
+func (b *MemoryBroker) QueueLen(name string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	q, ok := b.queues[name]
+	if !ok {
+		return 0
+	}
+	return len(q.messages)
+}
+
+func (b *MemoryBroker) nextName(prefix string) string {
+	b.seq++
+	return fmt.Sprintf("%s%d", prefix, b.seq)
+}
+
+// deleteQueue must be called with b.mu held.
+func (b *MemoryBroker) deleteQueue(name string) {
+	q, ok := b.queues[name]
+	if !ok {
+		return
+	}
+	delete(b.queues, name)
+	for c := range q.consumers {
+		c.cancel()
+	}
+	for _, ex := range b.exchanges {
+		kept := ex.bindings[:0]
+		for _, bnd := range ex.bindings {
+			if bnd.queue != name {
+				kept = append(kept, bnd)
+			}
+		}
+		ex.bindings = kept
+	}
+	b.cond.Broadcast()
+}
+
+// route returns the queues a message published to exchange with key reaches.
+// It must be called with b.mu held.
+func (b *MemoryBroker) route(ex *memExchange, key string) []*memQueue {
+	if ex.name == "" {
+		if q, ok := b.queues[key]; ok {
+			return []*memQueue{q}
+		}
+		return nil
+	}
+	seen := map[string]struct{}{}
+	var queues []*memQueue
+	for _, bnd := range ex.bindings {
+		var match bool
+		switch ex.kind {
+		case amqp.ExchangeDirect:
+			match = bnd.key == key
+		case amqp.ExchangeTopic:
+			match = MatchTopic(bnd.key, key)
+		case amqp.ExchangeFanout:
+			match = true
+		}
+		if !match {
+			continue
+		}
+		if _, ok := seen[bnd.queue]; ok {
+			continue
+		}
+		seen[bnd.queue] = struct{}{}
+		if q, ok := b.queues[bnd.queue]; ok {
+			queues = append(queues, q)
+		}
+	}
+	return queues
+}
+
+// publish routes msg and reports whether any queue accepted it. It must be
+// called with b.mu held.
+func (b *MemoryBroker) publish(exchange, key string, pub amqp.Publishing) (routed, rejected bool, err error) {
+	ex, ok := b.exchanges[exchange]
+	if !ok {
+		return false, false, &amqp.Error{Code: amqp.NotFound, Reason: fmt.Sprintf("NOT_FOUND - no exchange '%s'", exchange)}
+	}
+	queues := b.route(ex, key)
+	for _, q := range queues {
+		pub := pub
+		pub.Headers = copyTable(pub.Headers)
+		if !b.enqueue(q, &memMessage{exchange: exchange, key: key, pub: pub}) {
+			rejected = true
+		}
+	}
+	return len(queues) > 0, rejected, nil
+}
+
+// enqueue adds msg to q behind the messages of the same or higher priority,
+// making room first if q is at its x-max-length. It reports false if q's
+// overflow policy rejected msg.
+func (b *MemoryBroker) enqueue(q *memQueue, msg *memMessage) bool {
+	if limit, ok := intArg(q.args, "x-max-length"); ok && int64(len(q.messages)) >= limit {
+		switch q.args["x-overflow"] {
+		case string(OverflowRejectPublish):
+			return false
+		case string(OverflowRejectPublishDLX):
+			b.deadLetter(q, msg, "maxlen")
+			return false
+		}
+		for len(q.messages) > 0 && int64(len(q.messages)) >= limit {
+			head := q.messages[0]
+			q.messages = q.messages[1:]
+			b.deadLetter(q, head, "maxlen")
+		}
+		if limit <= 0 {
+			b.deadLetter(q, msg, "maxlen")
+			return true
+		}
+	}
+	if ttl, ok := messageTTL(q, msg.pub); ok {
+		msg.expires = time.Now().Add(ttl)
+		time.AfterFunc(ttl, b.sweep)
+	}
+	i := len(q.messages)
+	if maxPriority, ok := intArg(q.args, "x-max-priority"); ok {
+		priority := min(int64(msg.pub.Priority), maxPriority)
+		for i > 0 && min(int64(q.messages[i-1].pub.Priority), maxPriority) < priority {
+			i--
+		}
+	}
+	q.messages = slices.Insert(q.messages, i, msg)
+	b.cond.Broadcast()
+	return true
+}
+
+// messageTTL returns the lower of the queue's x-message-ttl and the message's
+// expiration, if either is set.
+func messageTTL(q *memQueue, pub amqp.Publishing) (time.Duration, bool) {
+	ttl, ok := time.Duration(0), false
+	if ms, isSet := intArg(q.args, "x-message-ttl"); isSet {
+		ttl, ok = time.Duration(ms)*time.Millisecond, true
+	}
+	if pub.Expiration != "" {
+		if ms, err := strconv.ParseInt(pub.Expiration, 10, 64); err == nil {
+			if d := time.Duration(ms) * time.Millisecond; !ok || d < ttl {
+				ttl, ok = d, true
+			}
+		}
+	}
+	return ttl, ok
+}
+
+func intArg(args amqp.Table, name string) (int64, bool) {
+	switch v := args[name].(type) {
+	case int:
+		return int64(v), true
+	case int8:
+		return int64(v), true
+	case int16:
+		return int64(v), true
+	case int32:
+		return int64(v), true
+	case int64:
+		return v, true
+	case uint8:
+		return int64(v), true
+	case uint16:
+		return int64(v), true
+	case uint32:
+		return int64(v), true
+	case float64:
+		return int64(v), true
+	}
+	return 0, false
+}
+
+// sweep dead-letters expired messages at the head of every queue.
+func (b *MemoryBroker) sweep() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, q := range b.queues {
+		b.expireHead(q)
+	}
+}
+
+// expireHead dead-letters expired messages from the head of q. Like
+// RabbitMQ, messages behind an unexpired one wait until they reach the head.
+// It must be called with b.mu held.
+func (b *MemoryBroker) expireHead(q *memQueue) {
+	now := time.Now()
+	for len(q.messages) > 0 {
+		msg := q.messages[0]
+		if msg.expires.IsZero() || msg.expires.After(now) {
+			return
+		}
+		q.messages = q.messages[1:]
+		b.deadLetter(q, msg, "expired")
+	}
+}
+
+func (b *MemoryBroker) requeue(q *memQueue, msg *memMessage) {
+	if _, ok := b.queues[q.name]; !ok {
+		return
+	}
+	msg.redelivered = true
+	if q.args["x-queue-type"] == "quorum" {
+		msg.returns++
+		if limit, ok := intArg(q.args, "x-delivery-limit"); ok && int64(msg.returns) > limit {
+			b.deadLetter(q, msg, "delivery_limit")
+			return
+		}
+		msg.pub.Headers = copyTable(msg.pub.Headers)
+		if msg.pub.Headers == nil {
+			msg.pub.Headers = amqp.Table{}
+		}
+		msg.pub.Headers["x-delivery-count"] = int64(msg.returns)
+	}
+	q.messages = append([]*memMessage{msg}, q.messages...)
+	b.cond.Broadcast()
+}
+
+// deadLetter republishes msg to the queue's dead-letter exchange, recording
+// the reason in the x-death header the way RabbitMQ does. Messages on queues
+// without a dead-letter exchange are dropped.
+func (b *MemoryBroker) deadLetter(q *memQueue, msg *memMessage, reason string) {
+	dlx, ok := q.args["x-dead-letter-exchange"].(string)
+	if !ok {
+		return
+	}
+	key := msg.key
+	if dlk, ok := q.args["x-dead-letter-routing-key"].(string); ok {
+		key = dlk
+	}
+
+	pub := msg.pub
+	pub.Headers = copyTable(pub.Headers)
+	if pub.Headers == nil {
+		pub.Headers = amqp.Table{}
+	}
+	pub.Expiration = ""
+
+	var deaths []interface{}
+	count := int64(1)
+	if prev, ok := pub.Headers["x-death"].([]interface{}); ok {
+		for _, d := range prev {
+			t, ok := d.(amqp.Table)
+			if ok && t["queue"] == q.name && t["reason"] == reason {
+				if n, ok := t["count"].(int64); ok {
+					count = n + 1
+				}
+				continue
+			}
+			deaths = append(deaths, d)
+		}
+	}
+	death := amqp.Table{
+		"count":        count,
+		"reason":       reason,
+		"queue":        q.name,
+		"time":         time.Now(),
+		"exchange":     msg.exchange,
+		"routing-keys": []interface{}{msg.key},
+	}
+	pub.Headers["x-death"] = append([]interface{}{death}, deaths...)
+	if _, ok := pub.Headers["x-first-death-reason"]; !ok {
+		pub.Headers["x-first-death-reason"] = reason
+		pub.Headers["x-first-death-queue"] = q.name
+		pub.Headers["x-first-death-exchange"] = msg.exchange
+	}
+	pub.Headers["x-last-death-reason"] = reason
+	pub.Headers["x-last-death-queue"] = q.name
+	pub.Headers["x-last-death-exchange"] = msg.exchange
+
+	b.publish(dlx, key, pub)
+}
+
+// MatchTopic reports whether key matches a topic binding pattern, where `*`
+// matches exactly one word and `#` matches zero or more words, as a topic
+// exchange would route it.
+func MatchTopic(pattern, key string) bool {
+	return matchWords(strings.Split(pattern, "."), strings.Split(key, "."))
+}
+
+func matchWords(pattern, words []string) bool {
+	if len(pattern) == 0 {
+		return len(words) == 0
+	}
+	switch pattern[0] {
+	case "#":
+		for i := 0; i <= len(words); i++ {
+			if matchWords(pattern[1:], words[i:]) {
+				return true
+			}
+		}
+		return false
+	case "*":
+		return len(words) > 0 && matchWords(pattern[1:], words[1:])
+	default:
+		return len(words) > 0 && pattern[0] == words[0] && matchWords(pattern[1:], words[1:])
+	}
+}
+
+func copyTable(t amqp.Table) amqp.Table {
+	if t == nil {
+		return nil
+	}
+	c := make(amqp.Table, len(t))
+	for k, v := range t {
+		c[k] = v
+	}
+	return c
+}
+
+func sameArgs(a, b amqp.Table) bool {
+	for k, v := range a {
+		if fmt.Sprint(v) != fmt.Sprint(b[k]) {
+			return false
+		}
+	}
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// MemoryConn is a connection to a MemoryBroker. It implements Broker.
+type MemoryConn struct {
+	broker   *MemoryBroker
+	channels map[*memChannel]struct{}
+	closes   []chan *amqp.Error
+	closed   bool
+}
+
+var _ Broker = (*MemoryConn)(nil)
+
+func (c *MemoryConn) Channel() (Channel, error) {
+	b := c.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if c.closed {
+		return nil, amqp.ErrClosed
+	}
+	ch := &memChannel{
+		conn:      c,
+		unacked:   map[uint64]*memUnacked{},
+		consumers: map[string]*memConsumer{},
+		notifier:  newMemNotifier(),
+	}
+	c.channels[ch] = struct{}{}
+	go ch.notifier.run()
+	return ch, nil
+}
+
+// NotifyClose registers a listener for the connection closing. As with
+// amqp091, the error is only sent when the close was not requested by the
+// client; the send does not block, so receivers should be buffered.
+func (c *MemoryConn) NotifyClose(receiver chan *amqp.Error) chan *amqp.Error {
+	b := c.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if c.closed {
+		close(receiver)
+		return receiver
+	}
+	c.closes = append(c.closes, receiver)
+	return receiver
+}
+
+// Close closes every channel on the connection and deletes the exclusive
+// queues it declared.
+func (c *MemoryConn) Close() error {
+	return c.shutdown(nil)
+}
+
+func (c *MemoryConn) shutdown(err *amqp.Error) error {
+	b := c.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if c.closed {
+		return amqp.ErrClosed
+	}
+	c.closed = true
+	for ch := range c.channels {
+		ch.close(err)
+	}
+	for name, q := range b.queues {
+		if q.exclusive && q.owner == c {
+			b.deleteQueue(name)
+		}
+	}
+	delete(b.conns, c)
+	notifyClosed(c.closes, err)
+	c.closes = nil
+	return nil
+}
+
+func notifyClosed(receivers []chan *amqp.Error, err *amqp.Error) {
+	for _, receiver := range receivers {
+		if err != nil {
+			select {
+			case receiver <- err:
+			default:
+			}
+		}
+		close(receiver)
+	}
+}
+
+type memChannel struct {
+	conn      *MemoryConn
+	prefetch  int
+	tag       uint64
+	unacked   map[uint64]*memUnacked
+	consumers map[string]*memConsumer
+	confirm   bool
+	published uint64
+	notifier  *memNotifier
+	closes    []chan *amqp.Error
+	closed    bool
+}
+
+type memUnacked struct {
+	queue    *memQueue
+	msg      *memMessage
+	consumer *memConsumer
+}
+
+var _ Channel = (*memChannel)(nil)
+var _ amqp.Acknowledger = (*memChannel)(nil)
+
+func (ch *memChannel) broker() *MemoryBroker {
+	return ch.conn.broker
+}
+
+func (ch *memChannel) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	routed, rejected, err := b.publish(exchange, key, msg)
+	if err != nil {
+		return err
+	}
+	if mandatory && !routed {
+		ch.notifier.push(amqp.Return{
+			ReplyCode:       amqp.NoRoute,
+			ReplyText:       "NO_ROUTE",
+			Exchange:        exchange,
+			RoutingKey:      key,
+			ContentType:     msg.ContentType,
+			ContentEncoding: msg.ContentEncoding,
+			Headers:         copyTable(msg.Headers),
+			DeliveryMode:    msg.DeliveryMode,
+			Priority:        msg.Priority,
+			CorrelationId:   msg.CorrelationId,
+			ReplyTo:         msg.ReplyTo,
+			Expiration:      msg.Expiration,
+			MessageId:       msg.MessageId,
+			Timestamp:       msg.Timestamp,
+			Type:            msg.Type,
+			UserId:          msg.UserId,
+			AppId:           msg.AppId,
+			Body:            msg.Body,
+		})
+	}
+	if ch.confirm {
+		ch.published++
+		ch.notifier.push(amqp.Confirmation{DeliveryTag: ch.published, Ack: !rejected})
+	}
+	return nil
+}
+
+func (ch *memChannel) Confirm(noWait bool) error {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	ch.confirm = true
+	return nil
+}
+
+func (ch *memChannel) NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation {
+	ch.notifier.addConfirm(confirm)
+	return confirm
+}
+
+func (ch *memChannel) NotifyReturn(c chan amqp.Return) chan amqp.Return {
+	ch.notifier.addReturn(c)
+	return c
+}
+
+func (ch *memChannel) ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	switch kind {
+	case amqp.ExchangeDirect, amqp.ExchangeTopic, amqp.ExchangeFanout, amqp.ExchangeHeaders:
+	default:
+		return &amqp.Error{Code: amqp.CommandInvalid, Reason: fmt.Sprintf("COMMAND_INVALID - unknown exchange type '%s'", kind)}
+	}
+	if ex, ok := b.exchanges[name]; ok {
+		if ex.kind != kind || ex.durable != durable {
+			return &amqp.Error{Code: amqp.PreconditionFailed, Reason: fmt.Sprintf("PRECONDITION_FAILED - inequivalent arg for exchange '%s'", name)}
+		}
+		return nil
+	}
+	b.exchanges[name] = &memExchange{name: name, kind: kind, durable: durable, autoDelete: autoDelete, internal: internal}
+	return nil
+}
+
+func (ch *memChannel) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.Queue{}, amqp.ErrClosed
+	}
+	if name == "" {
+		name = b.nextName("amq.gen-")
+	}
+	if args["x-queue-type"] == "stream" {
+		return amqp.Queue{}, &amqp.Error{Code: amqp.NotImplemented, Reason: "NOT_IMPLEMENTED - streams are not supported by MemoryBroker"}
+	}
+	if q, ok := b.queues[name]; ok {
+		if q.exclusive && q.owner != ch.conn {
+			return amqp.Queue{}, &amqp.Error{Code: amqp.ResourceLocked, Reason: fmt.Sprintf("RESOURCE_LOCKED - cannot obtain exclusive access to locked queue '%s'", name)}
+		}
+		if q.durable != durable || q.autoDelete != autoDelete || q.exclusive != exclusive || !sameArgs(q.args, args) {
+			return amqp.Queue{}, &amqp.Error{Code: amqp.PreconditionFailed, Reason: fmt.Sprintf("PRECONDITION_FAILED - inequivalent arg for queue '%s'", name)}
+		}
+		return amqp.Queue{Name: name, Messages: len(q.messages), Consumers: len(q.consumers)}, nil
+	}
+	q := &memQueue{
+		name:       name,
+		durable:    durable,
+		autoDelete: autoDelete,
+		exclusive:  exclusive,
+		args:       copyTable(args),
+		consumers:  map[*memConsumer]struct{}{},
+	}
+	if exclusive {
+		q.owner = ch.conn
+	}
+	b.queues[name] = q
+	return amqp.Queue{Name: name}, nil
+}
+
+func (ch *memChannel) QueueDeclarePassive(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.Queue{}, amqp.ErrClosed
+	}
+	q, ok := b.queues[name]
+	if !ok {
+		return amqp.Queue{}, &amqp.Error{Code: amqp.NotFound, Reason: fmt.Sprintf("NOT_FOUND - no queue '%s'", name)}
+	}
+	return amqp.Queue{Name: name, Messages: len(q.messages), Consumers: len(q.consumers)}, nil
+}
+
+func (ch *memChannel) QueuePurge(name string, noWait bool) (int, error) {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return 0, amqp.ErrClosed
+	}
+	q, ok := b.queues[name]
+	if !ok {
+		return 0, &amqp.Error{Code: amqp.NotFound, Reason: fmt.Sprintf("NOT_FOUND - no queue '%s'", name)}
+	}
+	n := len(q.messages)
+	q.messages = nil
+	return n, nil
+}
+
+func (ch *memChannel) Get(queue string, autoAck bool) (amqp.Delivery, bool, error) {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.Delivery{}, false, amqp.ErrClosed
+	}
+	q, ok := b.queues[queue]
+	if !ok {
+		return amqp.Delivery{}, false, &amqp.Error{Code: amqp.NotFound, Reason: fmt.Sprintf("NOT_FOUND - no queue '%s'", queue)}
+	}
+	b.expireHead(q)
+	if len(q.messages) == 0 {
+		return amqp.Delivery{}, false, nil
+	}
+	msg := q.messages[0]
+	q.messages = q.messages[1:]
+	d := ch.delivery(q, msg, nil, autoAck)
+	d.MessageCount = uint32(len(q.messages))
+	return d, true, nil
+}
+
+func (ch *memChannel) QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	if _, ok := b.queues[name]; !ok {
+		return &amqp.Error{Code: amqp.NotFound, Reason: fmt.Sprintf("NOT_FOUND - no queue '%s'", name)}
+	}
+	ex, ok := b.exchanges[exchange]
+	if !ok || exchange == "" {
+		return &amqp.Error{Code: amqp.NotFound, Reason: fmt.Sprintf("NOT_FOUND - no exchange '%s'", exchange)}
+	}
+	for _, bnd := range ex.bindings {
+		if bnd.queue == name && bnd.key == key {
+			return nil
+		}
+	}
+	ex.bindings = append(ex.bindings, memBinding{queue: name, key: key})
+	return nil
+}
+
+func (ch *memChannel) Qos(prefetchCount, prefetchSize int, global bool) error {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	ch.prefetch = prefetchCount
+	return nil
+}
+
+func (ch *memChannel) Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error) {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return nil, amqp.ErrClosed
+	}
+	q, ok := b.queues[queue]
+	if !ok {
+		return nil, &amqp.Error{Code: amqp.NotFound, Reason: fmt.Sprintf("NOT_FOUND - no queue '%s'", queue)}
+	}
+	if q.exclusive && q.owner != ch.conn {
+		return nil, &amqp.Error{Code: amqp.ResourceLocked, Reason: fmt.Sprintf("RESOURCE_LOCKED - cannot obtain exclusive access to locked queue '%s'", queue)}
+	}
+	if exclusive && len(q.consumers) > 0 {
+		return nil, &amqp.Error{Code: amqp.AccessRefused, Reason: fmt.Sprintf("ACCESS_REFUSED - queue '%s' in exclusive use", queue)}
+	}
+	if consumer == "" {
+		consumer = b.nextName("ctag-")
+	}
+	if _, ok := ch.consumers[consumer]; ok {
+		return nil, &amqp.Error{Code: amqp.NotAllowed, Reason: fmt.Sprintf("NOT_ALLOWED - attempt to reuse consumer tag '%s'", consumer)}
+	}
+	c := &memConsumer{
+		tag:      consumer,
+		queue:    q,
+		ch:       ch,
+		autoAck:  autoAck,
+		prefetch: ch.prefetch,
+		out:      make(chan amqp.Delivery),
+		done:     make(chan struct{}),
+	}
+	ch.consumers[consumer] = c
+	q.consumers[c] = struct{}{}
+	q.hadConsumer = true
+	go c.run()
+	return c.out, nil
+}
+
+// Cancel stops the consumer with the given tag. Deliveries it has already
+// handed out stay unacknowledged until they are settled.
+func (ch *memChannel) Cancel(consumer string, noWait bool) error {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	if c, ok := ch.consumers[consumer]; ok {
+		ch.removeConsumer(c)
+	}
+	return nil
+}
+
+func (ch *memChannel) NotifyClose(receiver chan *amqp.Error) chan *amqp.Error {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		close(receiver)
+		return receiver
+	}
+	ch.closes = append(ch.closes, receiver)
+	return receiver
+}
+
+func (ch *memChannel) Close() error {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	ch.close(nil)
+	return nil
+}
+
+// close cancels the channel's consumers and requeues everything it had not
+// acknowledged. It must be called with the broker lock held.
+func (ch *memChannel) close(err *amqp.Error) {
+	ch.closed = true
+	notifyClosed(ch.closes, err)
+	ch.closes = nil
+	ch.notifier.close()
+	delete(ch.conn.channels, ch)
+	for _, c := range ch.consumers {
+		ch.removeConsumer(c)
+	}
+	tags := make([]uint64, 0, len(ch.unacked))
+	for tag := range ch.unacked {
+		tags = append(tags, tag)
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i] > tags[j] })
+	for _, tag := range tags {
+		u := ch.unacked[tag]
+		delete(ch.unacked, tag)
+		ch.broker().requeue(u.queue, u.msg)
+	}
+}
+
+func (ch *memChannel) removeConsumer(c *memConsumer) {
+	b := ch.broker()
+	delete(ch.consumers, c.tag)
+	delete(c.queue.consumers, c)
+	c.cancel()
+	q := c.queue
+	if q.autoDelete && q.hadConsumer && len(q.consumers) == 0 {
+		b.deleteQueue(q.name)
+	}
+}
+
+func (ch *memChannel) Ack(tag uint64, multiple bool) error {
+	return ch.settle(tag, multiple, func(u *memUnacked) {})
+}
+
+func (ch *memChannel) Nack(tag uint64, multiple bool, requeue bool) error {
+	b := ch.broker()
+	return ch.settle(tag, multiple, func(u *memUnacked) {
+		if requeue {
+			b.requeue(u.queue, u.msg)
+			return
+		}
+		b.deadLetter(u.queue, u.msg, "rejected")
+	})
+}
+
+func (ch *memChannel) Reject(tag uint64, requeue bool) error {
+	return ch.Nack(tag, false, requeue)
+}
+
+func (ch *memChannel) settle(tag uint64, multiple bool, fn func(*memUnacked)) error {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	var tags []uint64
+	if multiple {
+		for t := range ch.unacked {
+			if t <= tag {
+				tags = append(tags, t)
+			}
+		}
+		sort.Slice(tags, func(i, j int) bool { return tags[i] > tags[j] })
+	} else {
+		if _, ok := ch.unacked[tag]; !ok {
+			return &amqp.Error{Code: amqp.PreconditionFailed, Reason: fmt.Sprintf("PRECONDITION_FAILED - unknown delivery tag %d", tag)}
+		}
+		tags = []uint64{tag}
+	}
+	for _, t := range tags {
+		u := ch.unacked[t]
+		delete(ch.unacked, t)
+		if u.consumer != nil {
+			u.consumer.unacked--
+		}
+		fn(u)
+	}
+	b.cond.Broadcast()
+	return nil
+}
+
+type memConsumer struct {
+	tag       string
+	queue     *memQueue
+	ch        *memChannel
+	autoAck   bool
+	prefetch  int
+	unacked   int
+	out       chan amqp.Delivery
+	done      chan struct{}
+	cancelled bool
+}
+
+// cancel stops the consumer. It must be called with the broker lock held.
+func (c *memConsumer) cancel() {
+	if c.cancelled {
+		return
+	}
+	c.cancelled = true
+	close(c.done)
+	c.ch.broker().cond.Broadcast()
+}
+
+func (c *memConsumer) run() {
+	defer close(c.out)
+	b := c.ch.broker()
+	for {
+		b.mu.Lock()
+		for !c.cancelled && !c.ready() {
+			b.cond.Wait()
+		}
+		if c.cancelled {
+			b.mu.Unlock()
+			return
+		}
+		msg := c.queue.messages[0]
+		c.queue.messages = c.queue.messages[1:]
+		d := c.delivery(msg)
+		b.mu.Unlock()
+
+		select {
+		case c.out <- d:
+		case <-c.done:
+			b.mu.Lock()
+			if c.autoAck {
+				b.requeue(c.queue, msg)
+			} else if u, ok := c.ch.unacked[d.DeliveryTag]; ok {
+				delete(c.ch.unacked, d.DeliveryTag)
+				b.requeue(u.queue, u.msg)
+			}
+			b.mu.Unlock()
+			return
+		}
+	}
+}
+
+func (c *memConsumer) ready() bool {
+	c.ch.broker().expireHead(c.queue)
+	if len(c.queue.messages) == 0 {
+		return false
+	}
+	return c.autoAck || c.prefetch == 0 || c.unacked < c.prefetch
+}
+
+// delivery builds the amqp.Delivery for msg and tracks it as unacknowledged.
+// It must be called with the broker lock held.
+func (c *memConsumer) delivery(msg *memMessage) amqp.Delivery {
+	d := c.ch.delivery(c.queue, msg, c, c.autoAck)
+	d.ConsumerTag = c.tag
+	return d
+}
+
+// delivery builds the amqp.Delivery for msg taken from q, tracking it as
+// unacknowledged unless autoAck is set. c is nil for basic.get. It must be
+// called with the broker lock held.
+func (ch *memChannel) delivery(q *memQueue, msg *memMessage, c *memConsumer, autoAck bool) amqp.Delivery {
+	ch.tag++
+	tag := ch.tag
+	if !autoAck {
+		ch.unacked[tag] = &memUnacked{queue: q, msg: msg, consumer: c}
+		if c != nil {
+			c.unacked++
+		}
+	}
+	pub := msg.pub
+	return amqp.Delivery{
+		Acknowledger:    ch,
+		Headers:         copyTable(pub.Headers),
+		ContentType:     pub.ContentType,
+		ContentEncoding: pub.ContentEncoding,
+		DeliveryMode:    pub.DeliveryMode,
+		Priority:        pub.Priority,
+		CorrelationId:   pub.CorrelationId,
+		ReplyTo:         pub.ReplyTo,
+		Expiration:      pub.Expiration,
+		MessageId:       pub.MessageId,
+		Timestamp:       pub.Timestamp,
+		Type:            pub.Type,
+		UserId:          pub.UserId,
+		AppId:           pub.AppId,
+		DeliveryTag:     tag,
+		Redelivered:     msg.redelivered,
+		Exchange:        msg.exchange,
+		RoutingKey:      msg.key,
+		Body:            pub.Body,
+	}
+}
+
+// memNotifier delivers returns and publisher confirms to a channel's
+// listeners in the order they happened, without holding the broker lock.
+// Like amqp091, sends block until each listener receives.
+type memNotifier struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	events   []interface{}
+	returns  []chan amqp.Return
+	confirms []chan amqp.Confirmation
+	closed   bool
+}
+
+func newMemNotifier() *memNotifier {
+	n := &memNotifier{}
+	n.cond = sync.NewCond(&n.mu)
+	return n
+}
+
+func (n *memNotifier) addReturn(c chan amqp.Return) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.closed {
+		close(c)
+		return
+	}
+	n.returns = append(n.returns, c)
+}
+
+func (n *memNotifier) addConfirm(c chan amqp.Confirmation) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.closed {
+		close(c)
+		return
+	}
+	n.confirms = append(n.confirms, c)
+}
+
+func (n *memNotifier) push(ev interface{}) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.events = append(n.events, ev)
+	n.cond.Signal()
+}
+
+func (n *memNotifier) close() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.closed = true
+	n.cond.Signal()
+}
+
+func (n *memNotifier) run() {
+	for {
+		n.mu.Lock()
+		for len(n.events) == 0 && !n.closed {
+			n.cond.Wait()
+		}
+		if len(n.events) == 0 {
+			returns, confirms := n.returns, n.confirms
+			n.returns, n.confirms = nil, nil
+			n.mu.Unlock()
+			for _, c := range returns {
+				close(c)
+			}
+			for _, c := range confirms {
+				close(c)
+			}
+			return
+		}
+		ev := n.events[0]
+		n.events = n.events[1:]
+		returns := append([]chan amqp.Return(nil), n.returns...)
+		confirms := append([]chan amqp.Confirmation(nil), n.confirms...)
+		n.mu.Unlock()
+
+		switch ev := ev.(type) {
+		case amqp.Return:
+			for _, c := range returns {
+				c <- ev
+			}
+		case amqp.Confirmation:
+			for _, c := range confirms {
+				c <- ev
+			}
+		}
+	}
+}
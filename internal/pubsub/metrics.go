@@ -0,0 +1,67 @@
+package pubsub
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Prometheus metrics, registered with the default registry.
+var (
+	publishedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "peril",
+		Subsystem: "pubsub",
+		Name:      "published_total",
+		Help:      "Messages published, by exchange and whether the publish succeeded.",
+	}, []string{"exchange", "outcome"})
+
+	publishDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "peril",
+		Subsystem: "pubsub",
+		Name:      "publish_duration_seconds",
+		Help:      "Time taken to publish a message, including waiting for a confirm.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"exchange"})
+
+	consumedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "peril",
+		Subsystem: "pubsub",
+		Name:      "consumed_total",
+		Help:      "Deliveries settled by subscriptions, by queue and AckType.",
+	}, []string{"queue", "ack"})
+
+	handlerDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "peril",
+		Subsystem: "pubsub",
+		Name:      "handler_duration_seconds",
+		Help:      "Time spent in subscription handlers, including middleware.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"queue"})
+
+	decodeFailuresTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "peril",
+		Subsystem: "pubsub",
+		Name:      "decode_failures_total",
+		Help:      "Deliveries whose body could not be decoded.",
+	}, []string{"queue"})
+
+	invalidKeysTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "peril",
+		Subsystem: "pubsub",
+		Name:      "invalid_routing_keys_total",
+		Help:      "Deliveries dead-lettered because WithKeyParser rejected their routing key.",
+	}, []string{"queue"})
+
+	channelReplacementsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "peril",
+		Subsystem: "pubsub",
+		Name:      "channel_replacements_total",
+		Help:      "Publisher pool channels reopened after the broker closed them.",
+	})
+)
+
+func publishOutcome(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "ok"
+}
@@ -0,0 +1,184 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Handler is a subscription handler with the message type erased, so that
+// middleware can be shared between subscriptions of different types.
+type Handler func(ctx context.Context, value any, meta Metadata) AckType
+
+// Middleware wraps a Handler with behaviour that runs around every delivery.
+type Middleware func(Handler) Handler
+
+// WithMiddleware wraps the subscription's handler in mw, the first one
+// outermost. It replaces the default Logging(slog.Default()); Recover is
+// always applied outside of everything else.
+func WithMiddleware(mw ...Middleware) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.middleware = mw
+	}
+}
+
+// WithoutMiddleware drops the default Logging(slog.Default()), for
+// subscriptions that handle too many messages to log each one. Recover is
+// still applied.
+func WithoutMiddleware() SubscribeOption {
+	return WithMiddleware()
+}
+
+func chain(h Handler, mw []Middleware) Handler {
+	for i := len(mw) - 1; i >= 0; i-- {
+		h = mw[i](h)
+	}
+	return h
+}
+
+func (a AckType) String() string {
+	switch a {
+	case Ack:
+		return "ack"
+	case NackRequeue:
+		return "nack requeue"
+	case NackDiscard:
+		return "nack discard"
+	}
+	return fmt.Sprintf("AckType(%d)", int(a))
+}
+
+// Recover turns a panicking handler into NackDiscard, so the message goes to
+// the dead-letter exchange instead of taking the consumer down with it.
+func Recover() Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, value any, meta Metadata) (ack AckType) {
+			defer func() {
+				if r := recover(); r != nil {
+					slog.Error("handler panicked",
+						"routing_key", meta.RoutingKey,
+						"message_id", meta.MessageID,
+						"panic", r,
+						"stack", string(debug.Stack()),
+					)
+					ack = NackDiscard
+				}
+			}()
+			return next(ctx, value, meta)
+		}
+	}
+}
+
+// Timing reports how long the rest of the chain took for each delivery.
+func Timing(observe func(meta Metadata, d time.Duration, ack AckType)) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, value any, meta Metadata) AckType {
+			start := time.Now()
+			ack := next(ctx, value, meta)
+			observe(meta, time.Since(start), ack)
+			return ack
+		}
+	}
+}
+
+// Logging logs the outcome of every delivery to logger. Nacks are logged as
+// warnings.
+func Logging(logger *slog.Logger) Middleware {
+	return Timing(func(meta Metadata, d time.Duration, ack AckType) {
+		level := slog.LevelInfo
+		if ack != Ack {
+			level = slog.LevelWarn
+		}
+		logger.Log(context.Background(), level, "handled message",
+			"exchange", meta.Exchange,
+			"routing_key", meta.RoutingKey,
+			"message_id", meta.MessageID,
+			"redelivered", meta.Redelivered,
+			"ack", ack.String(),
+			"duration", d,
+		)
+	})
+}
+
+// Gate holds deliveries back while it is paused. The zero value is open.
+type Gate struct {
+	mu      sync.Mutex
+	paused  bool
+	resumed chan struct{}
+}
+
+// Pause stops deliveries from passing the gate until Resume is called.
+func (g *Gate) Pause() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !g.paused {
+		g.paused = true
+		g.resumed = make(chan struct{})
+	}
+}
+
+// Resume lets held and future deliveries through.
+func (g *Gate) Resume() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.paused {
+		g.paused = false
+		close(g.resumed)
+	}
+}
+
+// Paused reports whether the gate is closed.
+func (g *Gate) Paused() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.paused
+}
+
+func (g *Gate) wait(ctx context.Context) error {
+	g.mu.Lock()
+	if !g.paused {
+		g.mu.Unlock()
+		return nil
+	}
+	resumed := g.resumed
+	g.mu.Unlock()
+	select {
+	case <-resumed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// PauseGate blocks each delivery until gate is open. The message stays
+// unacknowledged in the meantime, so prefetch bounds how many are held. If
+// the handler's context ends first the message is requeued.
+func PauseGate(gate *Gate) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, value any, meta Metadata) AckType {
+			if err := gate.wait(ctx); err != nil {
+				return NackRequeue
+			}
+			return next(ctx, value, meta)
+		}
+	}
+}
+
+// RateLimit lets at most limit deliveries per second through, with bursts
+// of up to burst. The limit is shared by every handler the middleware wraps.
+func RateLimit(limit rate.Limit, burst int) Middleware {
+	limiter := rate.NewLimiter(limit, burst)
+	return func(next Handler) Handler {
+		return func(ctx context.Context, value any, meta Metadata) AckType {
+			if err := limiter.Wait(ctx); err != nil {
+				return NackRequeue
+			}
+			return next(ctx, value, meta)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"golang.org/x/time/rate"
+)
+
+func TestWithMiddlewareOrder(t *testing.T) {
+	for _, tb := range testBrokers(t) {
+		t.Run(tb.name, func(t *testing.T) {
+			conn := tb.connect(t)
+			exchange := declareTestExchange(t, conn, amqp.ExchangeDirect)
+			pub := newTestPublisher(t, conn)
+			var mu sync.Mutex
+			var calls []string
+			record := func(name string) Middleware {
+				return func(next Handler) Handler {
+					return func(ctx context.Context, value any, meta Metadata) AckType {
+						mu.Lock()
+						calls = append(calls, name)
+						mu.Unlock()
+						return next(ctx, value, meta)
+					}
+				}
+			}
+			done := make(chan struct{}, 1)
+			sub, err := Subscribe(testContext(t), conn, exchange, "", "key", SimpleQueueTransient, func(context.Context, string) AckType {
+				mu.Lock()
+				calls = append(calls, "handler")
+				mu.Unlock()
+				done <- struct{}{}
+				return Ack
+			}, WithMiddleware(record("outer"), record("inner")))
+			if err != nil {
+				t.Fatalf("Subscribe: %v", err)
+			}
+			defer sub.Close()
+			if err := PublishJSON(context.Background(), pub, exchange, "key", "hello"); err != nil {
+				t.Fatalf("PublishJSON: %v", err)
+			}
+			receive(t, done)
+			mu.Lock()
+			defer mu.Unlock()
+			if got := fmt.Sprint(calls); got != "[outer inner handler]" {
+				t.Errorf("calls = %s, want [outer inner handler]", got)
+			}
+		})
+	}
+}
+
+func TestRecoverDeadLettersPanics(t *testing.T) {
+	for _, tb := range testBrokers(t) {
+		t.Run(tb.name, func(t *testing.T) {
+			conn := tb.connect(t)
+			exchange := declareTestExchange(t, conn, amqp.ExchangeDirect)
+			pub := newTestPublisher(t, conn)
+			dlx, dlq := declareDeadLetters(t, tb, conn)
+			handled := make(chan string, 1)
+			sub, err := Subscribe(testContext(t), conn, exchange, "", "key", SimpleQueueTransient, func(_ context.Context, s string) AckType {
+				if s == "panic" {
+					panic("bad message")
+				}
+				handled <- s
+				return Ack
+			}, WithQueueOptions(WithDeadLetterExchange(dlx)), WithoutMiddleware())
+			if err != nil {
+				t.Fatalf("Subscribe: %v", err)
+			}
+			defer sub.Close()
+
+			for _, s := range []string{"panic", "hello"} {
+				if err := PublishJSON(context.Background(), pub, exchange, "key", s); err != nil {
+					t.Fatalf("PublishJSON: %v", err)
+				}
+			}
+			if d := getMessage(t, conn, dlq); string(d.Body) != `"panic"` {
+				t.Errorf("dead-lettered %s, want the message that panicked", d.Body)
+			}
+			// The consumer survives the panic
+			if got := receive(t, handled); got != "hello" {
+				t.Errorf("handler got %q, want %q", got, "hello")
+			}
+		})
+	}
+}
+
+func TestPauseGate(t *testing.T) {
+	for _, tb := range testBrokers(t) {
+		t.Run(tb.name, func(t *testing.T) {
+			conn := tb.connect(t)
+			exchange := declareTestExchange(t, conn, amqp.ExchangeDirect)
+			pub := newTestPublisher(t, conn)
+			var gate Gate
+			gate.Pause()
+			handled := make(chan string, 1)
+			sub, err := Subscribe(testContext(t), conn, exchange, "", "key", SimpleQueueTransient, func(_ context.Context, s string) AckType {
+				handled <- s
+				return Ack
+			}, WithMiddleware(PauseGate(&gate)))
+			if err != nil {
+				t.Fatalf("Subscribe: %v", err)
+			}
+			defer sub.Close()
+			if err := PublishJSON(context.Background(), pub, exchange, "key", "hello"); err != nil {
+				t.Fatalf("PublishJSON: %v", err)
+			}
+			select {
+			case s := <-handled:
+				t.Fatalf("handler got %q while the gate was paused", s)
+			case <-time.After(100 * time.Millisecond):
+			}
+			gate.Resume()
+			if got := receive(t, handled); got != "hello" {
+				t.Errorf("handler got %q, want %q", got, "hello")
+			}
+		})
+	}
+}
+
+func TestHeldDeliveriesRequeue(t *testing.T) {
+	var paused Gate
+	paused.Pause()
+	cases := []struct {
+		name string
+		mw   Middleware
+		// let is how many deliveries get through before one is held.
+		let int
+	}{
+		{"paused gate", PauseGate(&paused), 0},
+		{"rate limit", RateLimit(rate.Every(time.Hour), 1), 1},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var calls int
+			h := c.mw(func(context.Context, any, Metadata) AckType {
+				calls++
+				return Ack
+			})
+			for i := 0; i < c.let; i++ {
+				h(context.Background(), nil, Metadata{})
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			if ack := h(ctx, nil, Metadata{}); ack != NackRequeue {
+				t.Errorf("held delivery settled with %v, want %v", ack, NackRequeue)
+			}
+			if calls != c.let {
+				t.Errorf("handler called %d times, want %d", calls, c.let)
+			}
+		})
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	const interval = 20 * time.Millisecond
+	cases := []struct {
+		name  string
+		burst int
+		calls int
+		// min is the least time the calls can take.
+		min time.Duration
+	}{
+		{"within the burst", 3, 3, 0},
+		{"beyond the burst", 1, 4, 3 * interval},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			h := RateLimit(rate.Every(interval), c.burst)(func(context.Context, any, Metadata) AckType {
+				return Ack
+			})
+			start := time.Now()
+			for i := 0; i < c.calls; i++ {
+				if ack := h(context.Background(), nil, Metadata{}); ack != Ack {
+					t.Fatalf("call %d settled with %v, want Ack", i, ack)
+				}
+			}
+			if d := time.Since(start); d < c.min-interval/2 {
+				t.Errorf("%d calls took %v, want at least %v", c.calls, d, c.min)
+			}
+		})
+	}
+}
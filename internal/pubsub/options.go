@@ -0,0 +1,124 @@
+package pubsub
+
+import (
+	"log/slog"
+	"time"
+)
+
+// PublishOption configures a single publish.
+type PublishOption func(*publishOptions)
+
+type publishOptions struct {
+	codec      Codec
+	messageID  string
+	expiration time.Duration
+	priority   uint8
+}
+
+func newPublishOptions(opts []PublishOption) publishOptions {
+	options := publishOptions{
+		codec: JSON,
+	}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	return options
+}
+
+// WithCodec sets the codec used to encode the message body.
+func WithCodec(c Codec) PublishOption {
+	return func(o *publishOptions) {
+		o.codec = c
+	}
+}
+
+// WithMessageID sets the message ID instead of generating a random one.
+func WithMessageID(id string) PublishOption {
+	return func(o *publishOptions) {
+		o.messageID = id
+	}
+}
+
+// WithExpiration discards the message, or dead-letters it, if it has not
+// been consumed within d of reaching a queue. A queue's WithMessageTTL still
+// applies when it is shorter.
+func WithExpiration(d time.Duration) PublishOption {
+	return func(o *publishOptions) {
+		o.expiration = d
+	}
+}
+
+// WithPriority sets the message priority, from 0 to 255. Queues declared
+// with WithMaxPriority deliver higher priority messages first; others ignore
+// it.
+func WithPriority(p uint8) PublishOption {
+	return func(o *publishOptions) {
+		o.priority = p
+	}
+}
+
+// SubscribeOption configures a subscription made with Subscribe,
+// SubscribeWithMetadata, SubscribeJSON or SubscribeGob.
+type SubscribeOption func(*subscribeOptions)
+
+type subscribeOptions struct {
+	codec         Codec
+	decodeFailure DecodeFailurePolicy
+	retry         *RetryPolicy
+	upgrades      map[int]upgrader
+	middleware    []Middleware
+	concurrency   int
+	orderedByKey  bool
+	timeout       time.Duration
+	queue         []QueueOption
+	streamOffset  *StreamOffset
+	parseKey      func(string) (any, error)
+}
+
+func newSubscribeOptions(opts []SubscribeOption) subscribeOptions {
+	options := subscribeOptions{
+		codec:         JSON,
+		decodeFailure: DiscardPoison,
+		middleware:    []Middleware{Logging(slog.Default())},
+		concurrency:   1,
+	}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	return options
+}
+
+// WithDefaultCodec sets the codec for deliveries that carry no content type.
+func WithDefaultCodec(c Codec) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.codec = c
+	}
+}
+
+// WithDecodeFailurePolicy sets what happens to deliveries whose body cannot
+// be decoded. The default is DiscardPoison.
+func WithDecodeFailurePolicy(policy DecodeFailurePolicy) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.decodeFailure = policy
+	}
+}
+
+// WithKeyParser parses the routing key of every delivery with parse and
+// passes the result to handlers as Metadata.Key. A delivery whose key does not
+// parse is dead-lettered without being decoded, and counted in
+// peril_pubsub_invalid_routing_keys_total.
+func WithKeyParser[K any](parse func(string) (K, error)) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.parseKey = func(key string) (any, error) {
+			return parse(key)
+		}
+	}
+}
+
+// WithHandlerTimeout gives every handler call a context that expires after d,
+// which bounds the publishes the handler makes with it.
+func WithHandlerTimeout(d time.Duration) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.timeout = d
+	}
+}
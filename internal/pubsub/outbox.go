@@ -0,0 +1,238 @@
+package pubsub
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"log"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	outboxBucket = []byte("outbox")
+	stateBucket  = []byte("state")
+	// failedBucket keeps the stored messages that could not be decoded, so
+	// they do not hold up the ones behind them.
+	failedBucket = []byte("failed")
+)
+
+func init() {
+	// Publishing headers are stored with gob, which needs the concrete types
+	// it may find behind interface{} values registered up front.
+	gob.Register(amqp.Table{})
+	gob.Register([]interface{}{})
+	gob.Register(time.Time{})
+}
+
+// Outbox keeps outgoing messages in a local bbolt database until they have
+// been published. A transaction can record application state alongside the
+// messages it causes, so either both are kept or neither is. Relay publishes
+// the stored messages, including those left over from before a restart.
+// Delivery is at-least-once: a message whose publish succeeded just before
+// a crash is sent again, with the same MessageId.
+type Outbox struct {
+	db   *bolt.DB
+	wake chan struct{}
+
+	dedupePruned time.Time
+}
+
+// OutboxTx is a transaction started by Outbox.Update.
+type OutboxTx struct {
+	outbox   *Outbox
+	tx       *bolt.Tx
+	enqueued bool
+}
+
+type outboxRecord struct {
+	Exchange string
+	Key      string
+	Msg      amqp.Publishing
+}
+
+// OpenOutbox opens or creates the outbox database at path.
+func OpenOutbox(path string) (*Outbox, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("could not open outbox: %w", err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{outboxBucket, stateBucket, failedBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("could not open outbox: %w", err)
+	}
+	return &Outbox{db: db, wake: make(chan struct{}, 1)}, nil
+}
+
+// Close closes the database. Messages not yet relayed are kept for the next
+// OpenOutbox.
+func (o *Outbox) Close() error {
+	return o.db.Close()
+}
+
+// Update runs fn in a read-write transaction. The state it puts and the
+// messages it enqueues are committed together if fn returns nil, and
+// discarded otherwise.
+func (o *Outbox) Update(fn func(tx *OutboxTx) error) error {
+	otx := &OutboxTx{outbox: o}
+	err := o.db.Update(func(tx *bolt.Tx) error {
+		otx.tx = tx
+		return fn(otx)
+	})
+	if err == nil && otx.enqueued {
+		select {
+		case o.wake <- struct{}{}:
+		default:
+		}
+	}
+	return err
+}
+
+// Get returns the state stored under key, or nil if there is none.
+func (o *Outbox) Get(key string) ([]byte, error) {
+	var value []byte
+	err := o.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(stateBucket).Get([]byte(key)); v != nil {
+			value = append([]byte(nil), v...)
+		}
+		return nil
+	})
+	return value, err
+}
+
+// Pending reports how many messages are waiting to be relayed.
+func (o *Outbox) Pending() (int, error) {
+	var n int
+	err := o.db.View(func(tx *bolt.Tx) error {
+		n = tx.Bucket(outboxBucket).Stats().KeyN
+		return nil
+	})
+	return n, err
+}
+
+// Put stores value under key as part of the transaction.
+func (tx *OutboxTx) Put(key string, value []byte) error {
+	return tx.tx.Bucket(stateBucket).Put([]byte(key), value)
+}
+
+// Enqueue encodes env like PublishEnvelope and stores it in the transaction's
+// outbox, to be published to exchange with key once the transaction commits.
+func Enqueue[T any](tx *OutboxTx, exchange, key string, env Envelope[T], opts ...PublishOption) error {
+	msg, err := encode(env, newPublishOptions(opts))
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(outboxRecord{Exchange: exchange, Key: key, Msg: msg}); err != nil {
+		return fmt.Errorf("could not encode outbox message: %w", err)
+	}
+	b := tx.tx.Bucket(outboxBucket)
+	seq, err := b.NextSequence()
+	if err != nil {
+		return err
+	}
+	if err := b.Put(binary.BigEndian.AppendUint64(nil, seq), buf.Bytes()); err != nil {
+		return err
+	}
+	tx.enqueued = true
+	return nil
+}
+
+// Relay publishes stored messages to ch in the order they were enqueued,
+// removing each once ch accepts it, until ctx is done. Give it a
+// ConfirmingPublisher or PublisherPool to only remove messages the broker
+// has confirmed.
+// When publishing fails it backs off and tries the same message again.
+func (o *Outbox) Relay(ctx context.Context, ch Publisher) error {
+	const (
+		minBackoff = 500 * time.Millisecond
+		maxBackoff = 30 * time.Second
+	)
+	backoff := minBackoff
+	for {
+		err := o.relayPending(ctx, ch)
+		wait := time.Duration(0)
+		switch {
+		case err == nil:
+			backoff = minBackoff
+		case ctx.Err() != nil:
+			return ctx.Err()
+		default:
+			log.Printf("could not relay outbox message, retrying in %v: %v", backoff, err)
+			wait = backoff
+			backoff = min(2*backoff, maxBackoff)
+		}
+
+		var retry <-chan time.Time
+		if wait > 0 {
+			retry = time.After(wait)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-o.wake:
+		case <-retry:
+		}
+	}
+}
+
+// relayPending publishes messages until the outbox is empty.
+func (o *Outbox) relayPending(ctx context.Context, ch Publisher) error {
+	for {
+		key, rec, err := o.next()
+		if err != nil || key == nil {
+			return err
+		}
+		if err := publish(ctx, ch, rec.Exchange, rec.Key, false, rec.Msg); err != nil {
+			return err
+		}
+		err = o.db.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket(outboxBucket).Delete(key)
+		})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// next returns the oldest stored message, or a nil key if there is none.
+// Messages that cannot be decoded are moved to the failed bucket on the way.
+func (o *Outbox) next() ([]byte, outboxRecord, error) {
+	var key []byte
+	var rec outboxRecord
+	err := o.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(outboxBucket)
+		for {
+			k, v := bucket.Cursor().First()
+			if k == nil {
+				return nil
+			}
+			err := gob.NewDecoder(bytes.NewReader(v)).Decode(&rec)
+			if err == nil {
+				key = append([]byte(nil), k...)
+				return nil
+			}
+			log.Printf("moving undecodable outbox message %x aside: %v", k, err)
+			if err := tx.Bucket(failedBucket).Put(k, v); err != nil {
+				return err
+			}
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+			rec = outboxRecord{}
+		}
+	})
+	return key, rec, err
+}
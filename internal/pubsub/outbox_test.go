@@ -0,0 +1,138 @@
+package pubsub
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestOutboxRelay(t *testing.T) {
+	cases := []struct {
+		name string
+		// fill stores messages for exchange in o, returning the values that
+		// should be relayed in order.
+		fill func(t *testing.T, o *Outbox, exchange string) []string
+		// failed is how many stored messages are moved aside.
+		failed int
+	}{
+		{"in enqueue order", func(t *testing.T, o *Outbox, exchange string) []string {
+			for _, batch := range [][]string{{"a", "b"}, {"c"}, {"d", "e"}} {
+				enqueue(t, o, exchange, batch...)
+			}
+			return []string{"a", "b", "c", "d", "e"}
+		}, 0},
+		{"rolled back transaction", func(t *testing.T, o *Outbox, exchange string) []string {
+			enqueue(t, o, exchange, "a")
+			err := o.Update(func(tx *OutboxTx) error {
+				if err := Enqueue(tx, exchange, "key", Envelope[string]{Value: "lost"}); err != nil {
+					return err
+				}
+				return errors.New("rolled back")
+			})
+			if err == nil {
+				t.Fatal("Update succeeded, want the rollback error")
+			}
+			enqueue(t, o, exchange, "b")
+			return []string{"a", "b"}
+		}, 0},
+		{"undecodable message", func(t *testing.T, o *Outbox, exchange string) []string {
+			enqueue(t, o, exchange, "a")
+			err := o.db.Update(func(tx *bolt.Tx) error {
+				b := tx.Bucket(outboxBucket)
+				seq, err := b.NextSequence()
+				if err != nil {
+					return err
+				}
+				return b.Put(binary.BigEndian.AppendUint64(nil, seq), []byte("not gob"))
+			})
+			if err != nil {
+				t.Fatalf("storing a broken message: %v", err)
+			}
+			enqueue(t, o, exchange, "b")
+			return []string{"a", "b"}
+		}, 1},
+	}
+	for _, tb := range testBrokers(t) {
+		t.Run(tb.name, func(t *testing.T) {
+			conn := tb.connect(t)
+			pub := newTestPublisher(t, conn)
+			for _, c := range cases {
+				t.Run(c.name, func(t *testing.T) {
+					exchange := declareTestExchange(t, conn, amqp.ExchangeDirect)
+					ch, q, err := DeclareAndBind(conn, exchange, "", "key", SimpleQueueTransient)
+					if err != nil {
+						t.Fatalf("DeclareAndBind: %v", err)
+					}
+					defer ch.Close()
+
+					// Messages are stored before a restart and relayed after
+					path := filepath.Join(t.TempDir(), "test.outbox")
+					o, err := OpenOutbox(path)
+					if err != nil {
+						t.Fatalf("OpenOutbox: %v", err)
+					}
+					want := c.fill(t, o, exchange)
+					o.Close()
+					o, err = OpenOutbox(path)
+					if err != nil {
+						t.Fatalf("OpenOutbox: %v", err)
+					}
+					defer o.Close()
+					ctx, cancel := context.WithCancel(context.Background())
+					relayed := make(chan error, 1)
+					go func() { relayed <- o.Relay(ctx, pub) }()
+					defer func() {
+						cancel()
+						<-relayed
+					}()
+
+					var got []string
+					for range want {
+						got = append(got, string(getMessage(t, conn, q.Name).Body))
+					}
+					wantBodies := make([]string, len(want))
+					for i, v := range want {
+						wantBodies[i] = fmt.Sprintf("%q", v)
+					}
+					if fmt.Sprint(got) != fmt.Sprint(wantBodies) {
+						t.Errorf("relayed %v, want %v", got, wantBodies)
+					}
+					eventually(t, "the outbox is empty", func() bool {
+						n, err := o.Pending()
+						return err == nil && n == 0
+					})
+					var failed int
+					o.db.View(func(tx *bolt.Tx) error {
+						failed = tx.Bucket(failedBucket).Stats().KeyN
+						return nil
+					})
+					if failed != c.failed {
+						t.Errorf("%d messages moved aside, want %d", failed, c.failed)
+					}
+				})
+			}
+		})
+	}
+}
+
+// enqueue stores values for exchange in one transaction.
+func enqueue(t *testing.T, o *Outbox, exchange string, values ...string) {
+	t.Helper()
+	err := o.Update(func(tx *OutboxTx) error {
+		for _, v := range values {
+			if err := Enqueue(tx, exchange, "key", Envelope[string]{Value: v}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+}
@@ -0,0 +1,69 @@
+package pubsub
+
+import (
+	"crypto/sha256"
+	"sync"
+	"sync/atomic"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+var poisonMessages atomic.Uint64
+
+// PoisonMessageCount reports how many deliveries have failed to decode since
+// the process started, across every subscription.
+func PoisonMessageCount() uint64 {
+	return poisonMessages.Load()
+}
+
+// PoisonMessage is a delivery whose body could not be decoded into the
+// subscription's type.
+type PoisonMessage struct {
+	Body        []byte
+	ContentType string
+	Exchange    string
+	RoutingKey  string
+	Headers     amqp.Table
+	Redelivered bool
+	Err         error
+}
+
+// DecodeFailurePolicy decides how a poison message is acknowledged. Any
+// function with this signature can be used as a hook, e.g. to log or store
+// the raw body before returning NackDiscard.
+type DecodeFailurePolicy func(PoisonMessage) AckType
+
+// DiscardPoison rejects the message without requeueing, which sends it to the
+// dead-letter exchange.
+func DiscardPoison(PoisonMessage) AckType {
+	return NackDiscard
+}
+
+// maxTrackedPoison bounds the memory RequeuePoison uses to count attempts.
+const maxTrackedPoison = 1024
+
+// RequeuePoison requeues a poison message up to n times, e.g. to give a newer
+// consumer that understands the payload a chance to take it, then discards
+// it to the dead-letter exchange. Attempts are counted in memory by body and
+// routing key, so each subscription should get its own policy.
+func RequeuePoison(n int) DecodeFailurePolicy {
+	var mu sync.Mutex
+	attempts := map[[sha256.Size]byte]int{}
+	return func(msg PoisonMessage) AckType {
+		id := sha256.Sum256(append([]byte(msg.RoutingKey+"\x00"), msg.Body...))
+		mu.Lock()
+		defer mu.Unlock()
+		if attempts[id] >= n {
+			delete(attempts, id)
+			return NackDiscard
+		}
+		if len(attempts) >= maxTrackedPoison {
+			for k := range attempts {
+				delete(attempts, k)
+				break
+			}
+		}
+		attempts[id]++
+		return NackRequeue
+	}
+}
@@ -0,0 +1,71 @@
+package pubsub
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestDecodeFailurePolicy(t *testing.T) {
+	cases := []struct {
+		name   string
+		policy DecodeFailurePolicy
+		// attempts is how many times the poison message is delivered.
+		attempts int
+	}{
+		{"discard", DiscardPoison, 1},
+		{"requeue once", RequeuePoison(1), 2},
+		{"requeue three times", RequeuePoison(3), 4},
+	}
+	for _, tb := range testBrokers(t) {
+		t.Run(tb.name, func(t *testing.T) {
+			conn := tb.connect(t)
+			exchange := declareTestExchange(t, conn, amqp.ExchangeTopic)
+			pub := newTestPublisher(t, conn)
+			for _, c := range cases {
+				t.Run(c.name, func(t *testing.T) {
+					dlx, dlq := declareDeadLetters(t, tb, conn)
+					var attempts, handled atomic.Int32
+					var body atomic.Value
+					policy := func(msg PoisonMessage) AckType {
+						attempts.Add(1)
+						body.Store(string(msg.Body))
+						return c.policy(msg)
+					}
+					before := PoisonMessageCount()
+					sub, err := Subscribe(testContext(t), conn, exchange, "", "war.*", SimpleQueueTransient, func(context.Context, string) AckType {
+						handled.Add(1)
+						return Ack
+					}, WithDecodeFailurePolicy(policy), WithQueueOptions(WithDeadLetterExchange(dlx)), WithoutMiddleware())
+					if err != nil {
+						t.Fatalf("Subscribe: %v", err)
+					}
+					defer sub.Close()
+
+					msg := amqp.Publishing{ContentType: "application/json", Body: []byte("{not json")}
+					if err := pub.PublishWithContext(context.Background(), exchange, "war.alice", true, false, msg); err != nil {
+						t.Fatalf("PublishWithContext: %v", err)
+					}
+					d := getMessage(t, conn, dlq)
+					if string(d.Body) != "{not json" {
+						t.Errorf("dead-lettered body = %q, want the original", d.Body)
+					}
+					if got := int(attempts.Load()); got != c.attempts {
+						t.Errorf("policy called %d times, want %d", got, c.attempts)
+					}
+					if got := body.Load(); got != "{not json" {
+						t.Errorf("policy got body %v, want the original", got)
+					}
+					if got := PoisonMessageCount() - before; got != uint64(c.attempts) {
+						t.Errorf("PoisonMessageCount grew by %d, want %d", got, c.attempts)
+					}
+					if n := handled.Load(); n != 0 {
+						t.Errorf("handler called %d times, want none", n)
+					}
+				})
+			}
+		})
+	}
+}
@@ -0,0 +1,220 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// PublisherPool is a Publisher that is safe to use from many goroutines. It
+// spreads publishes over a fixed number of channels, each owned by its own
+// ConfirmingPublisher and locked while a message is written to it, so
+// concurrent publishes never share a channel mid-frame and a slow publish
+// only holds up one channel. A channel the broker closes, for example after
+// a publish to a missing exchange, is replaced with a fresh one from the
+// connection, and a publish that fails because its channel closed is tried
+// once more on another channel. The channels of a ManagedBroker replace
+// themselves, so the pool only replaces one the managed broker gave up on.
+type PublisherPool struct {
+	conn    Broker
+	timeout time.Duration
+	slots   []*poolSlot
+	next    atomic.Uint64
+	closed  atomic.Bool
+}
+
+// poolSlot is one channel of a PublisherPool. mu is held while publishing on
+// it and while it is replaced.
+type poolSlot struct {
+	mu     sync.Mutex
+	ch     Channel
+	pub    *ConfirmingPublisher
+	closes chan *amqp.Error
+}
+
+var _ Publisher = (*PublisherPool)(nil)
+
+// NewPublisherPool opens size channels on conn in confirm mode. timeout
+// bounds how long PublishWithContext waits for a confirm, as for
+// NewConfirmingPublisher.
+func NewPublisherPool(conn Broker, size int, timeout time.Duration) (*PublisherPool, error) {
+	p := &PublisherPool{
+		conn:    conn,
+		timeout: timeout,
+		slots:   make([]*poolSlot, max(size, 1)),
+	}
+	for i := range p.slots {
+		s := &poolSlot{}
+		if err := p.open(s); err != nil {
+			p.Close()
+			return nil, err
+		}
+		p.slots[i] = s
+	}
+	return p, nil
+}
+
+// PublishWithContext publishes msg on one of the pool's channels and waits
+// for the broker to confirm it. mandatory and immediate are ignored: every
+// publish is mandatory, so a message no queue is bound for fails with a
+// *ReturnError instead of being dropped.
+func (p *PublisherPool) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	d, err := p.PublishDeferred(ctx, exchange, key, msg)
+	if err != nil {
+		return err
+	}
+	if _, ok := ctx.Deadline(); !ok && p.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.timeout)
+		defer cancel()
+	}
+	return d.Wait(ctx)
+}
+
+// PublishDeferred publishes msg on one of the pool's channels without
+// waiting for the confirm.
+func (p *PublisherPool) PublishDeferred(ctx context.Context, exchange, key string, msg amqp.Publishing) (*DeferredConfirm, error) {
+	// Keep the same ID if the publish is tried again on another channel
+	if msg.MessageId == "" {
+		msg.MessageId = newMessageID()
+	}
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		s := p.acquire()
+		var d *DeferredConfirm
+		d, err = p.publishOn(ctx, s, exchange, key, msg)
+		retired := s.pub == nil
+		s.mu.Unlock()
+		if err == nil || !retired {
+			return d, err
+		}
+	}
+	return nil, err
+}
+
+// ConfirmTimeout returns the timeout the pool was created with.
+func (p *PublisherPool) ConfirmTimeout() time.Duration {
+	return p.timeout
+}
+
+// Close closes every channel of the pool. Publishes still awaiting a confirm
+// fail with ErrNacked.
+func (p *PublisherPool) Close() error {
+	if p.closed.Swap(true) {
+		return nil
+	}
+	var errs []error
+	for _, s := range p.slots {
+		if s == nil {
+			continue
+		}
+		s.mu.Lock()
+		if s.ch != nil {
+			if err := s.ch.Close(); err != nil && !errors.Is(err, amqp.ErrClosed) {
+				errs = append(errs, err)
+			}
+		}
+		s.ch, s.pub = nil, nil
+		s.mu.Unlock()
+	}
+	return errors.Join(errs...)
+}
+
+// acquire locks and returns a free channel, starting from the next one in
+// turn, or waits for the next one in turn if every channel is busy.
+func (p *PublisherPool) acquire() *poolSlot {
+	n := uint64(len(p.slots))
+	start := p.next.Add(1)
+	for i := uint64(0); i < n; i++ {
+		s := p.slots[(start+i)%n]
+		if s.mu.TryLock() {
+			return s
+		}
+	}
+	s := p.slots[start%n]
+	s.mu.Lock()
+	return s
+}
+
+// publishOn publishes msg on s, replacing its channel first if it has
+// closed. If the publish fails because the channel has closed, the channel is
+// retired so the next publish on s replaces it. It must be called with s.mu
+// held.
+func (p *PublisherPool) publishOn(ctx context.Context, s *poolSlot, exchange, key string, msg amqp.Publishing) (*DeferredConfirm, error) {
+	if p.closed.Load() {
+		return nil, amqp.ErrClosed
+	}
+	if !s.healthy() {
+		if err := p.open(s); err != nil {
+			return nil, fmt.Errorf("could not replace closed channel: %w", err)
+		}
+		channelReplacementsTotal.Inc()
+	}
+	d, err := s.pub.PublishDeferred(ctx, exchange, key, msg)
+	if err != nil && (errors.Is(err, amqp.ErrClosed) || !s.healthy()) {
+		s.pub = nil
+	}
+	return d, err
+}
+
+// healthy reports whether the channel of s is still open. It must be called
+// with s.mu held.
+func (s *poolSlot) healthy() bool {
+	if s.pub == nil {
+		return false
+	}
+	select {
+	case <-s.closes:
+		return false
+	default:
+		return true
+	}
+}
+
+// open gives s a new channel in confirm mode, closing the one it had, and
+// starts watching it. It must be called with s.mu held.
+func (p *PublisherPool) open(s *poolSlot) error {
+	if s.ch != nil {
+		s.ch.Close()
+	}
+	s.ch, s.pub = nil, nil
+	ch, err := p.conn.Channel()
+	if err != nil {
+		return err
+	}
+	pub, err := NewConfirmingPublisher(ch, p.timeout)
+	if err != nil {
+		ch.Close()
+		return err
+	}
+	s.ch, s.pub = ch, pub
+	s.closes = ch.NotifyClose(make(chan *amqp.Error, 1))
+	go p.watch(s, s.closes)
+	return nil
+}
+
+// watch replaces the channel of s as soon as the broker closes it, so the
+// next publish does not have to. If that fails the next publish tries again.
+func (p *PublisherPool) watch(s *poolSlot, closes chan *amqp.Error) {
+	err, ok := <-closes
+	if !ok || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if p.closed.Load() || s.closes != closes {
+		return
+	}
+	log.Printf("publisher channel closed: %v; opening a new one", err)
+	if err := p.open(s); err != nil {
+		log.Printf("could not replace publisher channel: %v", err)
+		return
+	}
+	channelReplacementsTotal.Inc()
+}
@@ -0,0 +1,172 @@
+package pubsub
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestPublisherPoolReplacesClosedChannels(t *testing.T) {
+	cases := []struct {
+		name string
+		// memory reports whether MemoryBroker can break a channel this way.
+		memory bool
+		// breakChannel closes one of the pool's channels.
+		breakChannel func(t *testing.T, p *PublisherPool)
+	}{
+		{"closed by the client", true, func(t *testing.T, p *PublisherPool) {
+			s := p.slots[0]
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			s.ch.Close()
+		}},
+		{"closed by the broker", false, func(t *testing.T, p *PublisherPool) {
+			// RabbitMQ closes the channel of a publish to a missing exchange
+			p.PublishWithContext(context.Background(), testName("missing"), "key", true, false, amqp.Publishing{})
+		}},
+	}
+	for _, tb := range testBrokers(t) {
+		t.Run(tb.name, func(t *testing.T) {
+			conn := tb.connect(t)
+			exchange := declareTestExchange(t, conn, amqp.ExchangeDirect)
+			ch, q, err := DeclareAndBind(conn, exchange, "", "key", SimpleQueueTransient)
+			if err != nil {
+				t.Fatalf("DeclareAndBind: %v", err)
+			}
+			defer ch.Close()
+			for _, c := range cases {
+				t.Run(c.name, func(t *testing.T) {
+					if tb.name == "memory" && !c.memory {
+						t.Skip("MemoryBroker does not close channels on errors")
+					}
+					p, err := NewPublisherPool(conn, 2, 5*time.Second)
+					if err != nil {
+						t.Fatalf("NewPublisherPool: %v", err)
+					}
+					defer p.Close()
+					before := make([]Channel, len(p.slots))
+					for i, s := range p.slots {
+						before[i] = s.ch
+					}
+					c.breakChannel(t, p)
+
+					// Every channel is used in turn, so the broken one is too
+					const n = 10
+					start := queueLen(t, conn, q.Name)
+					for i := 0; i < n; i++ {
+						if err := PublishJSON(context.Background(), p, exchange, "key", i); err != nil {
+							t.Fatalf("publish %d: %v", i, err)
+						}
+					}
+					if got := queueLen(t, conn, q.Name) - start; got != n {
+						t.Errorf("%d messages routed, want %d", got, n)
+					}
+					replaced := 0
+					for i, s := range p.slots {
+						s.mu.Lock()
+						if s.ch != before[i] {
+							replaced++
+						}
+						s.mu.Unlock()
+					}
+					if replaced != 1 {
+						t.Errorf("%d channels replaced, want 1", replaced)
+					}
+				})
+			}
+		})
+	}
+}
+
+// refusingConn is a MemoryConn that fails to open channels while refuse is
+// set.
+type refusingConn struct {
+	*MemoryConn
+	refuse atomic.Bool
+}
+
+func (c *refusingConn) Channel() (Channel, error) {
+	if c.refuse.Load() {
+		return nil, &amqp.Error{Code: amqp.ChannelError, Reason: "CHANNEL_ERROR - too many channels"}
+	}
+	return c.MemoryConn.Channel()
+}
+
+func TestPublisherPoolOnManagedBroker(t *testing.T) {
+	cases := []struct {
+		name string
+		// refuse fails the managed broker's attempt to reopen the channel.
+		refuse   bool
+		replaced int
+	}{
+		{"reopened by the managed broker", false, 0},
+		{"given up by the managed broker", true, 1},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			conn := &refusingConn{MemoryConn: NewMemoryBroker().Connect()}
+			defer conn.Close()
+			broker, err := NewManagedBroker(func() (Broker, error) {
+				return conn, nil
+			}, WithBackoff(10*time.Millisecond, 50*time.Millisecond))
+			if err != nil {
+				t.Fatalf("NewManagedBroker: %v", err)
+			}
+			defer broker.Close()
+			exchange := declareTestExchange(t, broker, amqp.ExchangeDirect)
+			ch, q, err := DeclareAndBind(broker, exchange, "", "key", SimpleQueueTransient)
+			if err != nil {
+				t.Fatalf("DeclareAndBind: %v", err)
+			}
+			defer ch.Close()
+			p, err := NewPublisherPool(broker, 2, 5*time.Second)
+			if err != nil {
+				t.Fatalf("NewPublisherPool: %v", err)
+			}
+			defer p.Close()
+			before := make([]Channel, len(p.slots))
+			for i, s := range p.slots {
+				before[i] = s.ch
+			}
+
+			// Kill the channel under the first slot's managed channel
+			mc := p.slots[0].ch.(*managedChannel)
+			mc.mu.Lock()
+			killed := mc.ch.(*memChannel)
+			mc.mu.Unlock()
+			conn.refuse.Store(c.refuse)
+			killChannel(killed)
+			eventually(t, "the managed broker has reopened or closed the channel", func() bool {
+				mc.mu.Lock()
+				defer mc.mu.Unlock()
+				return mc.closed || (mc.ch != nil && mc.ch != Channel(killed))
+			})
+			conn.refuse.Store(false)
+
+			// Every channel is used in turn, so the broken one is too
+			const n = 10
+			for i := 0; i < n; i++ {
+				if err := PublishJSON(context.Background(), p, exchange, "key", i); err != nil {
+					t.Fatalf("publish %d: %v", i, err)
+				}
+			}
+			if got := queueLen(t, broker, q.Name); got != n {
+				t.Errorf("%d messages routed, want %d", got, n)
+			}
+			replaced := 0
+			for i, s := range p.slots {
+				s.mu.Lock()
+				if s.ch != before[i] {
+					replaced++
+				}
+				s.mu.Unlock()
+			}
+			if replaced != c.replaced {
+				t.Errorf("%d channels replaced, want %d", replaced, c.replaced)
+			}
+		})
+	}
+}
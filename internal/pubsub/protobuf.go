@@ -0,0 +1,94 @@
+package pubsub
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// Protobuf encodes proto.Message values directly, and plain Go structs
+// through converters registered with RegisterProtoType.
+var Protobuf Codec = protobufCodec{}
+
+func init() {
+	RegisterCodec(Protobuf)
+}
+
+type protoConverter struct {
+	toProto   func(any) proto.Message
+	fromProto func(proto.Message) any
+	newProto  func() proto.Message
+}
+
+var (
+	protoTypesMu sync.RWMutex
+	protoTypes   = map[reflect.Type]protoConverter{}
+)
+
+// RegisterProtoType lets the Protobuf codec encode and decode T by converting
+// it to and from the generated message M.
+func RegisterProtoType[T any, M proto.Message](to func(T) M, from func(M) T) {
+	protoTypesMu.Lock()
+	defer protoTypesMu.Unlock()
+	protoTypes[reflect.TypeOf((*T)(nil)).Elem()] = protoConverter{
+		toProto:   func(v any) proto.Message { return to(v.(T)) },
+		fromProto: func(m proto.Message) any { return from(m.(M)) },
+		newProto: func() proto.Message {
+			var zero M
+			return zero.ProtoReflect().Type().New().Interface()
+		},
+	}
+}
+
+func protoConverterFor(t reflect.Type) (protoConverter, bool) {
+	protoTypesMu.RLock()
+	defer protoTypesMu.RUnlock()
+	c, ok := protoTypes[t]
+	return c, ok
+}
+
+type protobufCodec struct{}
+
+func (protobufCodec) ContentType() string { return "application/x-protobuf" }
+
+func (protobufCodec) Marshal(v any) ([]byte, error) {
+	if m, ok := v.(proto.Message); ok {
+		return proto.Marshal(m)
+	}
+	c, ok := protoConverterFor(reflect.TypeOf(v))
+	if !ok {
+		return nil, fmt.Errorf("no protobuf message registered for %T", v)
+	}
+	return proto.Marshal(c.toProto(v))
+}
+
+func (protobufCodec) Unmarshal(data []byte, v any) error {
+	if m, ok := v.(proto.Message); ok {
+		return proto.Unmarshal(data, m)
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return fmt.Errorf("protobuf: cannot unmarshal into non-pointer %T", v)
+	}
+	// Generated messages are always used through pointers, so *T may
+	// itself be a **Message.
+	if m, ok := rv.Elem().Interface().(proto.Message); ok && rv.Elem().Kind() == reflect.Pointer {
+		if rv.Elem().IsNil() {
+			m = m.ProtoReflect().Type().New().Interface()
+			rv.Elem().Set(reflect.ValueOf(m))
+		}
+		return proto.Unmarshal(data, m)
+	}
+	c, ok := protoConverterFor(rv.Elem().Type())
+	if !ok {
+		return fmt.Errorf("no protobuf message registered for %s", rv.Elem().Type())
+	}
+	m := c.newProto()
+	if err := proto.Unmarshal(data, m); err != nil {
+		return err
+	}
+	rv.Elem().Set(reflect.ValueOf(c.fromProto(m)))
+	return nil
+}
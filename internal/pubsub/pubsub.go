@@ -1,12 +1,9 @@
 package pubsub
 
 import (
-	"bytes"
 	"context"
-	"encoding/gob"
-	"encoding/json"
 	"fmt"
-	"log"
+	"time"
 
 	amqp "github.com/rabbitmq/amqp091-go"
 )
@@ -24,30 +21,37 @@ type SimpleQueueType int
 const (
 	SimpleQueueDurable SimpleQueueType = iota
 	SimpleQueueTransient
+	// SimpleQueueQuorum is a durable, replicated quorum queue. See
+	// WithDeliveryLimit.
+	SimpleQueueQuorum
+	// SimpleQueueStream is a durable, append-only stream that keeps messages
+	// after they are consumed, so they can be read again. See
+	// WithStreamOffset.
+	SimpleQueueStream
 )
 
 func DeclareAndBind(
-	conn *amqp.Connection,
+	conn Broker,
 	exchange,
 	queueName,
 	key string,
-	simpleQueueType SimpleQueueType, // an enum to represent "durable" or "transient"
-) (*amqp.Channel, amqp.Queue, error) {
+	simpleQueueType SimpleQueueType, // an enum to represent the kind of queue
+	opts ...QueueOption,
+) (Channel, amqp.Queue, error) {
 	// Create a channel to start the process
 	ch, err := conn.Channel()
 	if err != nil {
 		return nil, amqp.Queue{}, err
 	}
-	args := amqp.Table{
-		"x-dead-letter-exchange": "peril_dlx",
-	}
+	durable, autoDelete, exclusive := simpleQueueType.flags()
+	args := simpleQueueType.args(newQueueOptions(opts))
 	queue, err := ch.QueueDeclare(
-		queueName,                             // name
-		simpleQueueType == SimpleQueueDurable, // durable
-		simpleQueueType != SimpleQueueDurable, // delete when unused
-		simpleQueueType != SimpleQueueDurable, // exclusive
-		false,                                 // no-wait
-		args,                                  // arguments
+		queueName,  // name
+		durable,    // durable
+		autoDelete, // delete when unused
+		exclusive,  // exclusive
+		false,      // no-wait
+		args,       // arguments
 	)
 	if err != nil {
 		return nil, amqp.Queue{}, fmt.Errorf("could not declare queue: %v", err)
@@ -67,109 +71,199 @@ func DeclareAndBind(
 	return ch, queue, nil
 }
 
-func PublishJSON[T any](ch *amqp.Channel, exchange, key string, val T) error {
-	ctx := context.Background()
+// Publish encodes val with the codec chosen by WithCodec, JSON by default,
+// and publishes it with that codec's content type. The message gets the
+// default Envelope metadata. ctx bounds the publish, including waiting for a
+// confirm or a reconnect when ch does either.
+func Publish[T any](ctx context.Context, ch Publisher, exchange, key string, val T, opts ...PublishOption) error {
+	return PublishEnvelope(ctx, ch, exchange, key, Envelope[T]{Value: val}, opts...)
+}
 
-	jsonVal, err := json.Marshal(val)
-	if err != nil {
-		return err
-	}
+func PublishJSON[T any](ctx context.Context, ch Publisher, exchange, key string, val T, opts ...PublishOption) error {
+	return Publish(ctx, ch, exchange, key, val, append(opts, WithCodec(JSON))...)
+}
 
-	msg := amqp.Publishing{Body: jsonVal, ContentType: "application/json"}
-	return ch.PublishWithContext(ctx, exchange, key, false, false, msg)
+func PublishGob[T any](ctx context.Context, ch Publisher, exchange, key string, val T, opts ...PublishOption) error {
+	return Publish(ctx, ch, exchange, key, val, append(opts, WithCodec(Gob))...)
 }
 
-func SubscribeJSON[T any](conn *amqp.Connection, exchange, queueName, key string, simpleQueueType SimpleQueueType, handler func(T) AckType) error {
-	unmarshaller := func(body []byte) (T, error) {
-		var msg T
-		return msg, json.Unmarshal(body, &msg)
-	}
-	return subscribe(conn, exchange, queueName, key, simpleQueueType, handler, unmarshaller)
+// Subscribe decodes each delivery with the codec registered for its content
+// type, so producers can switch formats without breaking running consumers.
+// Deliveries without a content type are decoded with WithDefaultCodec, JSON
+// by default.
+// The subscription runs until ctx is done or it is closed. Handlers get a
+// context that is cancelled when the subscription stops and carries the
+// delivery's Metadata.
+func Subscribe[T any](ctx context.Context, conn Broker, exchange, queueName, key string, simpleQueueType SimpleQueueType, handler func(context.Context, T) AckType, opts ...SubscribeOption) (*Subscription, error) {
+	return subscribe(ctx, conn, exchange, queueName, key, simpleQueueType, withoutMetadata(handler), opts...)
 }
 
-func SubscribeGob[T any](conn *amqp.Connection, exchange, queueName, key string, simpleQueueType SimpleQueueType, handler func(T) AckType) error {
-	unmarshaller := func(data []byte) (T, error) {
-		buffer := bytes.NewBuffer(data)
-		gobDecoder := gob.NewDecoder(buffer)
-		var msg T
-		return msg, gobDecoder.Decode(&msg)
-	}
-	return subscribe(conn, exchange, queueName, key, simpleQueueType, handler, unmarshaller)
+// SubscribeWithMetadata is Subscribe for handlers that also need the
+// message's Metadata.
+func SubscribeWithMetadata[T any](ctx context.Context, conn Broker, exchange, queueName, key string, simpleQueueType SimpleQueueType, handler func(context.Context, T, Metadata) AckType, opts ...SubscribeOption) (*Subscription, error) {
+	return subscribe(ctx, conn, exchange, queueName, key, simpleQueueType, handler, opts...)
+}
+
+func SubscribeJSON[T any](ctx context.Context, conn Broker, exchange, queueName, key string, simpleQueueType SimpleQueueType, handler func(context.Context, T) AckType, opts ...SubscribeOption) (*Subscription, error) {
+	return subscribe(ctx, conn, exchange, queueName, key, simpleQueueType, withoutMetadata(handler), append([]SubscribeOption{WithDefaultCodec(JSON)}, opts...)...)
+}
+
+func SubscribeGob[T any](ctx context.Context, conn Broker, exchange, queueName, key string, simpleQueueType SimpleQueueType, handler func(context.Context, T) AckType, opts ...SubscribeOption) (*Subscription, error) {
+	return subscribe(ctx, conn, exchange, queueName, key, simpleQueueType, withoutMetadata(handler), append([]SubscribeOption{WithDefaultCodec(Gob)}, opts...)...)
 }
 
 func subscribe[T any](
-	conn *amqp.Connection,
+	ctx context.Context,
+	conn Broker,
 	exchange,
 	queueName,
 	key string,
 	simpleQueueType SimpleQueueType,
-	handler func(T) AckType,
-	unmarshaller func([]byte) (T, error),
-) error {
-	// Make sure the queue exists and bound to the exchange
-	amqpCh, amqpQueue, err := DeclareAndBind(conn, exchange, queueName, key, simpleQueueType)
+	handler func(context.Context, T, Metadata) AckType,
+	opts ...SubscribeOption,
+) (*Subscription, error) {
+	options := newSubscribeOptions(opts)
+
+	// Limit the prefetch count for consumer to 10, or more when there are
+	// enough workers to need it
+	amqpCh, amqpQueue, tag, deliveryCh, err := consume(conn, exchange, queueName, key, simpleQueueType, prefetchFor(options.concurrency), options)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	wrapped := chain(func(ctx context.Context, value any, meta Metadata) AckType {
+		return handler(ctx, value.(T), meta)
+	}, append([]Middleware{Recover()}, options.middleware...))
+
+	sub := newSubscription(ctx, amqpCh, tag)
+
+	process := func(delivery amqp.Delivery) {
+		spanCtx, span := startConsumeSpan(sub.ctx, amqpQueue.Name, delivery)
+		meta, err := metadataFor(delivery, options)
+		if err != nil {
+			ackType := keyRejected(amqpQueue.Name, delivery, err)
+			endConsumeSpan(span, ackType, err)
+			consumedTotal.WithLabelValues(amqpQueue.Name, ackType.String()).Inc()
+			settle(delivery, ackType)
+			return
+		}
+		v, err := decode[T](delivery, options)
+		if err != nil {
+			ackType := decodeFailed(amqpQueue.Name, delivery, err, options)
+			endConsumeSpan(span, ackType, err)
+			consumedTotal.WithLabelValues(amqpQueue.Name, ackType.String()).Inc()
+			settle(delivery, ackType)
+			return
+		}
+		// Call the provided handler with the unmarshaled message
+		handlerCtx := contextWithMetadata(spanCtx, meta)
+		if options.timeout > 0 {
+			var cancel context.CancelFunc
+			handlerCtx, cancel = context.WithTimeout(handlerCtx, options.timeout)
+			defer cancel()
+		}
+		start := time.Now()
+		ackType := wrapped(handlerCtx, v, meta)
+		handlerDuration.WithLabelValues(amqpQueue.Name).Observe(time.Since(start).Seconds())
+		if ackType == NackRequeue && options.retry != nil {
+			ackType = options.retry.retry(amqpCh, amqpQueue.Name, delivery)
+		}
+		endConsumeSpan(span, ackType, nil)
+		consumedTotal.WithLabelValues(amqpQueue.Name, ackType.String()).Inc()
+		settle(delivery, ackType)
 	}
 
-	// Limit the prefetch count for consumer to 10
-	err = amqpCh.Qos(10, 0, false)
+	go func() {
+		dispatch(deliveryCh, options.concurrency, options.orderedByKey, process)
+		sub.stop()
+	}()
+
+	return sub, nil
+}
+
+// consume declares and binds the queue, sets its prefetch and retry queues,
+// and starts consuming it with a fresh consumer tag.
+func consume(conn Broker, exchange, queueName, key string, simpleQueueType SimpleQueueType, prefetch int, options subscribeOptions) (Channel, amqp.Queue, string, <-chan amqp.Delivery, error) {
+	if options.retry != nil && simpleQueueType == SimpleQueueStream {
+		return nil, amqp.Queue{}, "", nil, errStreamRetry
+	}
+
+	// Make sure the queue exists and bound to the exchange
+	amqpCh, amqpQueue, err := DeclareAndBind(conn, exchange, queueName, key, simpleQueueType, options.queue...)
 	if err != nil {
-		return err
+		return nil, amqp.Queue{}, "", nil, err
 	}
 
-	deliveryCh, err := amqpCh.Consume(amqpQueue.Name, "", false, false, false, false, nil)
+	err = amqpCh.Qos(prefetch, 0, false)
 	if err != nil {
-		return err
+		return nil, amqp.Queue{}, "", nil, err
 	}
 
-	go func() {
-		for delivery := range deliveryCh {
-			body := delivery.Body
-			v, err := unmarshaller(body)
-			if err != nil {
-				fmt.Printf("failed to unmarshal message: %v\n", err)
-				continue
-			}
-			// Call the provided handler with the unmarshaled message
-			actType := handler(v)
-			// Acknowledge the message
-			switch actType {
-			case Ack:
-				log.Println("Ack")
-				err = delivery.Ack(false)
-				if err != nil {
-					fmt.Printf("failed to acknowledge message: %v\n", err)
-				}
-			case NackRequeue:
-				log.Println("Nack re queue")
-				err = delivery.Nack(false, true)
-				if err != nil {
-					fmt.Printf("failed to nack and re queue message: %v\n", err)
-				}
-			case NackDiscard:
-				log.Println("Nack discard")
-				err = delivery.Nack(false, false)
-				if err != nil {
-					fmt.Printf("failed to nack and re queue message: %v\n", err)
-				}
-			}
+	if options.retry != nil {
+		err = options.retry.declareRetryQueues(amqpCh, amqpQueue.Name, simpleQueueType)
+		if err != nil {
+			return nil, amqp.Queue{}, "", nil, err
 		}
-	}()
+	}
 
-	return nil
+	tag := "ctag-" + newMessageID()
+	deliveryCh, err := amqpCh.Consume(amqpQueue.Name, tag, false, false, false, false, options.consumeArgs())
+	if err != nil {
+		return nil, amqp.Queue{}, "", nil, err
+	}
+	return amqpCh, amqpQueue, tag, deliveryCh, nil
+}
+
+// decodeFailed counts a delivery that could not be decoded and returns how
+// the decode failure policy wants it settled.
+func decodeFailed(queue string, delivery amqp.Delivery, err error, options subscribeOptions) AckType {
+	poisonMessages.Add(1)
+	decodeFailuresTotal.WithLabelValues(queue).Inc()
+	fmt.Printf("failed to unmarshal message: %v\n", err)
+	return options.decodeFailure(PoisonMessage{
+		Body:        delivery.Body,
+		ContentType: delivery.ContentType,
+		Exchange:    delivery.Exchange,
+		RoutingKey:  delivery.RoutingKey,
+		Headers:     delivery.Headers,
+		Redelivered: delivery.Redelivered,
+		Err:         err,
+	})
 }
 
-func PublishGob[T any](ch *amqp.Channel, exchange, key string, val T) error {
-	ctx := context.Background()
+// keyRejected counts a delivery whose routing key WithKeyParser rejected and
+// returns NackDiscard to dead-letter it. Its body may well be fine, so it is
+// not counted as a poison message.
+func keyRejected(queue string, delivery amqp.Delivery, err error) AckType {
+	invalidKeysTotal.WithLabelValues(queue).Inc()
+	fmt.Printf("rejected routing key %q: %v\n", delivery.RoutingKey, err)
+	return NackDiscard
+}
 
-	var buffer bytes.Buffer
-	encoder := gob.NewEncoder(&buffer)
-	err := encoder.Encode(val)
-	if err != nil {
-		return err
+func withoutMetadata[T any](handler func(context.Context, T) AckType) func(context.Context, T, Metadata) AckType {
+	return func(ctx context.Context, v T, _ Metadata) AckType {
+		return handler(ctx, v)
 	}
+}
 
-	msg := amqp.Publishing{Body: buffer.Bytes(), ContentType: "application/gob"}
-	return ch.PublishWithContext(ctx, exchange, key, false, false, msg)
+// settle acknowledges the delivery according to actType.
+func settle(delivery amqp.Delivery, actType AckType) {
+	var err error
+	switch actType {
+	case Ack:
+		err = delivery.Ack(false)
+		if err != nil {
+			fmt.Printf("failed to acknowledge message: %v\n", err)
+		}
+	case NackRequeue:
+		err = delivery.Nack(false, true)
+		if err != nil {
+			fmt.Printf("failed to nack and re queue message: %v\n", err)
+		}
+	case NackDiscard:
+		err = delivery.Nack(false, false)
+		if err != nil {
+			fmt.Printf("failed to nack and re queue message: %v\n", err)
+		}
+	}
 }
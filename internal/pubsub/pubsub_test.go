@@ -0,0 +1,222 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestTopicRouting(t *testing.T) {
+	cases := []struct {
+		pattern string
+		key     string
+		routed  bool
+	}{
+		{"army_moves.*", "army_moves.alice", true},
+		{"army_moves.*", "army_moves", false},
+		{"army_moves.*", "army_moves.alice.bob", false},
+		{"army_moves.#", "army_moves", true},
+		{"army_moves.#", "army_moves.alice.bob", true},
+		{"#", "war.alice", true},
+		{"*.alice", "war.alice", true},
+		{"*.alice", "war.bob", false},
+		{"war.alice", "war.alice", true},
+		{"war.alice", "war.alicex", false},
+	}
+	for _, tb := range testBrokers(t) {
+		t.Run(tb.name, func(t *testing.T) {
+			conn := tb.connect(t)
+			pub := newTestPublisher(t, conn)
+			for _, c := range cases {
+				t.Run(c.pattern+" "+c.key, func(t *testing.T) {
+					exchange := declareTestExchange(t, conn, amqp.ExchangeTopic)
+					ch, q, err := DeclareAndBind(conn, exchange, "", c.pattern, SimpleQueueTransient)
+					if err != nil {
+						t.Fatalf("DeclareAndBind: %v", err)
+					}
+					defer ch.Close()
+					err = PublishJSON(context.Background(), pub, exchange, c.key, "hello")
+					var returned *ReturnError
+					if c.routed && err != nil {
+						t.Fatalf("PublishJSON: %v", err)
+					}
+					if !c.routed && !errors.As(err, &returned) {
+						t.Fatalf("PublishJSON = %v, want a *ReturnError", err)
+					}
+					if got, want := queueLen(t, conn, q.Name), map[bool]int{true: 1, false: 0}[c.routed]; got != want {
+						t.Errorf("queue has %d messages, want %d", got, want)
+					}
+				})
+			}
+		})
+	}
+}
+
+func TestSubscribeAckTypes(t *testing.T) {
+	cases := []struct {
+		ack          AckType
+		deadLettered bool
+	}{
+		{Ack, false},
+		{NackDiscard, true},
+	}
+	for _, tb := range testBrokers(t) {
+		t.Run(tb.name, func(t *testing.T) {
+			conn := tb.connect(t)
+			exchange := declareTestExchange(t, conn, amqp.ExchangeTopic)
+			pub := newTestPublisher(t, conn)
+			for _, c := range cases {
+				t.Run(c.ack.String(), func(t *testing.T) {
+					dlx, dlq := declareDeadLetters(t, tb, conn)
+					queue := testName("queue")
+					handled := make(chan string, 1)
+					sub, err := Subscribe(testContext(t), conn, exchange, queue, "war.*", SimpleQueueTransient, func(_ context.Context, s string) AckType {
+						handled <- s
+						return c.ack
+					}, WithQueueOptions(WithDeadLetterExchange(dlx)), WithoutMiddleware())
+					if err != nil {
+						t.Fatalf("Subscribe: %v", err)
+					}
+					defer sub.Close()
+
+					if err := PublishJSON(context.Background(), pub, exchange, "war.alice", "hello"); err != nil {
+						t.Fatalf("PublishJSON: %v", err)
+					}
+					if got := receive(t, handled); got != "hello" {
+						t.Fatalf("handler got %q, want %q", got, "hello")
+					}
+					if !c.deadLettered {
+						sub.Close()
+						if n := queueLen(t, conn, dlq); n != 0 {
+							t.Fatalf("%d messages dead-lettered, want none", n)
+						}
+						return
+					}
+					d := getMessage(t, conn, dlq)
+					exchange, key, ok := Origin(d.Headers)
+					if !ok || key != "war.alice" {
+						t.Errorf("Origin = %q, %q, %v; want the original exchange and key", exchange, key, ok)
+					}
+				})
+			}
+		})
+	}
+}
+
+func TestSubscribeNackRequeueRedelivers(t *testing.T) {
+	for _, tb := range testBrokers(t) {
+		t.Run(tb.name, func(t *testing.T) {
+			conn := tb.connect(t)
+			exchange := declareTestExchange(t, conn, amqp.ExchangeDirect)
+			pub := newTestPublisher(t, conn)
+			redelivered := make(chan bool, 2)
+			var calls atomic.Int32
+			sub, err := SubscribeWithMetadata(testContext(t), conn, exchange, testName("queue"), "key", SimpleQueueTransient, func(_ context.Context, _ string, meta Metadata) AckType {
+				redelivered <- meta.Redelivered
+				if calls.Add(1) == 1 {
+					return NackRequeue
+				}
+				return Ack
+			}, WithoutMiddleware())
+			if err != nil {
+				t.Fatalf("Subscribe: %v", err)
+			}
+			defer sub.Close()
+			if err := PublishJSON(context.Background(), pub, exchange, "key", "hello"); err != nil {
+				t.Fatalf("PublishJSON: %v", err)
+			}
+			if receive(t, redelivered) {
+				t.Error("first delivery is marked redelivered")
+			}
+			if !receive(t, redelivered) {
+				t.Error("second delivery is not marked redelivered")
+			}
+		})
+	}
+}
+
+func TestWithKeyParser(t *testing.T) {
+	parse := func(key string) (string, error) {
+		if !strings.HasPrefix(key, "war.") {
+			return "", fmt.Errorf("unknown routing key %q", key)
+		}
+		return strings.TrimPrefix(key, "war."), nil
+	}
+	cases := []struct {
+		name string
+		key  string
+		body string
+		want any
+		// rejected reports whether the key is dead-lettered without the
+		// handler or the decode failure policy seeing the delivery.
+		rejected bool
+	}{
+		{"parsed", "war.alice", `"hello"`, "alice", false},
+		{"rejected", "move.alice", `"hello"`, nil, true},
+		{"rejected before decoding", "move.alice", "{not json", nil, true},
+	}
+	for _, tb := range testBrokers(t) {
+		t.Run(tb.name, func(t *testing.T) {
+			conn := tb.connect(t)
+			exchange := declareTestExchange(t, conn, amqp.ExchangeTopic)
+			pub := newTestPublisher(t, conn)
+			for _, c := range cases {
+				t.Run(c.name, func(t *testing.T) {
+					dlx, dlq := declareDeadLetters(t, tb, conn)
+					queue := testName("queue")
+					tb.remove(t, queue)
+					keys := make(chan any, 1)
+					var policyCalls atomic.Int32
+					policy := func(PoisonMessage) AckType {
+						policyCalls.Add(1)
+						return NackDiscard
+					}
+					invalid := invalidKeysTotal.WithLabelValues(queue)
+					before, poisonBefore := testutil.ToFloat64(invalid), PoisonMessageCount()
+					sub, err := SubscribeWithMetadata(testContext(t), conn, exchange, queue, "#", SimpleQueueTransient, func(_ context.Context, _ string, meta Metadata) AckType {
+						keys <- meta.Key
+						return Ack
+					}, WithKeyParser(parse), WithDecodeFailurePolicy(policy), WithQueueOptions(WithDeadLetterExchange(dlx)), WithoutMiddleware())
+					if err != nil {
+						t.Fatalf("Subscribe: %v", err)
+					}
+					defer sub.Close()
+					msg := amqp.Publishing{ContentType: "application/json", Body: []byte(c.body)}
+					if err := pub.PublishWithContext(context.Background(), exchange, c.key, false, false, msg); err != nil {
+						t.Fatalf("PublishWithContext: %v", err)
+					}
+					if !c.rejected {
+						if got := receive(t, keys); got != c.want {
+							t.Errorf("Metadata.Key = %v, want %v", got, c.want)
+						}
+						return
+					}
+
+					if d := getMessage(t, conn, dlq); d.RoutingKey != c.key {
+						t.Errorf("dead-lettered key = %q, want %q", d.RoutingKey, c.key)
+					}
+					select {
+					case key := <-keys:
+						t.Errorf("handler called with key %v, want it not called", key)
+					default:
+					}
+					if got := testutil.ToFloat64(invalid) - before; got != 1 {
+						t.Errorf("invalid_routing_keys_total grew by %v, want 1", got)
+					}
+					if n := policyCalls.Load(); n != 0 {
+						t.Errorf("decode failure policy called %d times, want none", n)
+					}
+					if got := PoisonMessageCount() - poisonBefore; got != 0 {
+						t.Errorf("PoisonMessageCount grew by %d, want 0", got)
+					}
+				})
+			}
+		})
+	}
+}
@@ -0,0 +1,190 @@
+package pubsub
+
+import (
+	"errors"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// QueueOption configures a queue declared by DeclareAndBind.
+type QueueOption func(*queueOptions)
+
+// DeadLetterExchange is where queues declared by DeclareAndBind dead-letter
+// to unless WithDeadLetterExchange names another.
+const DeadLetterExchange = "peril_dlx"
+
+type queueOptions struct {
+	deadLetterExchange string
+	deliveryLimit      int
+	messageTTL         time.Duration
+	maxLength          int
+	overflow           Overflow
+	maxPriority        uint8
+}
+
+func newQueueOptions(opts []QueueOption) queueOptions {
+	options := queueOptions{deadLetterExchange: DeadLetterExchange}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	return options
+}
+
+// WithDeadLetterExchange sends the messages the queue rejects, expires or
+// drops to the named exchange instead of DeadLetterExchange. An empty name
+// discards them. Streams ignore it.
+func WithDeadLetterExchange(name string) QueueOption {
+	return func(o *queueOptions) {
+		o.deadLetterExchange = name
+	}
+}
+
+// WithDeliveryLimit dead-letters a message once it has been returned to a
+// SimpleQueueQuorum queue more than n times, so a message that keeps
+// crashing its consumer does not loop forever. Other queue types ignore it.
+func WithDeliveryLimit(n int) QueueOption {
+	return func(o *queueOptions) {
+		o.deliveryLimit = n
+	}
+}
+
+// WithMessageTTL discards messages, or dead-letters them, once they have
+// been in the queue for d without being consumed.
+func WithMessageTTL(d time.Duration) QueueOption {
+	return func(o *queueOptions) {
+		o.messageTTL = d
+	}
+}
+
+// Overflow is what a queue declared with WithMaxLength does with a message
+// published while it is full.
+type Overflow string
+
+const (
+	// OverflowDropHead dead-letters the oldest message to make room. It is
+	// RabbitMQ's default.
+	OverflowDropHead Overflow = "drop-head"
+	// OverflowRejectPublish drops the new message and nacks its publish.
+	OverflowRejectPublish Overflow = "reject-publish"
+	// OverflowRejectPublishDLX is OverflowRejectPublish, but also
+	// dead-letters the dropped message.
+	OverflowRejectPublishDLX Overflow = "reject-publish-dlx"
+)
+
+// WithMaxLength holds at most n ready messages in the queue, applying
+// overflow to the messages published beyond that. An empty overflow leaves
+// the choice to the broker.
+func WithMaxLength(n int, overflow Overflow) QueueOption {
+	return func(o *queueOptions) {
+		o.maxLength = n
+		o.overflow = overflow
+	}
+}
+
+// WithMaxPriority makes the queue deliver messages with a higher WithPriority
+// first. Priorities above n count as n. RabbitMQ recommends n of 10 or less.
+func WithMaxPriority(n uint8) QueueOption {
+	return func(o *queueOptions) {
+		o.maxPriority = n
+	}
+}
+
+// WithQueueOptions passes opts to DeclareAndBind when the subscription
+// declares its queue.
+func WithQueueOptions(opts ...QueueOption) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.queue = append(o.queue, opts...)
+	}
+}
+
+// flags returns the durable, auto-delete and exclusive flags of the queue.
+func (t SimpleQueueType) flags() (durable, autoDelete, exclusive bool) {
+	if t == SimpleQueueTransient {
+		return false, true, true
+	}
+	return true, false, false
+}
+
+// args returns the queue arguments for t. Streams cannot dead-letter and
+// have limits of their own, so they get neither the dead-letter exchange nor
+// the TTL, length and priority arguments.
+func (t SimpleQueueType) args(options queueOptions) amqp.Table {
+	args := amqp.Table{}
+	if t != SimpleQueueStream {
+		if options.messageTTL > 0 {
+			args["x-message-ttl"] = options.messageTTL.Milliseconds()
+		}
+		if options.maxLength > 0 {
+			args["x-max-length"] = int64(options.maxLength)
+		}
+		if options.overflow != "" {
+			args["x-overflow"] = string(options.overflow)
+		}
+		if options.maxPriority > 0 {
+			args["x-max-priority"] = int64(options.maxPriority)
+		}
+	}
+	switch t {
+	case SimpleQueueQuorum:
+		args["x-queue-type"] = "quorum"
+		if options.deliveryLimit > 0 {
+			args["x-delivery-limit"] = int64(options.deliveryLimit)
+		}
+	case SimpleQueueStream:
+		args["x-queue-type"] = "stream"
+		return args
+	}
+	if options.deadLetterExchange != "" {
+		args["x-dead-letter-exchange"] = options.deadLetterExchange
+	}
+	return args
+}
+
+// errStreamRetry is returned when WithRetry is used on a stream, whose
+// messages are never removed and so cannot be parked in a retry queue.
+var errStreamRetry = errors.New("pubsub: WithRetry cannot be used with SimpleQueueStream")
+
+// StreamOffset is where a subscription to a SimpleQueueStream starts
+// reading.
+type StreamOffset struct {
+	value any
+}
+
+var (
+	// StreamOffsetFirst starts at the oldest message still in the stream.
+	StreamOffsetFirst = StreamOffset{"first"}
+	// StreamOffsetLast starts at the last chunk written to the stream.
+	StreamOffsetLast = StreamOffset{"last"}
+	// StreamOffsetNext starts with the next message published. It is the
+	// default.
+	StreamOffsetNext = StreamOffset{"next"}
+)
+
+// StreamOffsetAt starts at the messages published from t on.
+func StreamOffsetAt(t time.Time) StreamOffset {
+	return StreamOffset{t}
+}
+
+// StreamOffsetNumber starts at the message with the given offset, as found
+// in the x-stream-offset header of an earlier delivery.
+func StreamOffsetNumber(n int64) StreamOffset {
+	return StreamOffset{n}
+}
+
+// WithStreamOffset sets where a subscription to a SimpleQueueStream starts.
+// Every subscription reads the stream from its own offset, and messages stay
+// in the stream after they are acknowledged.
+func WithStreamOffset(offset StreamOffset) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.streamOffset = &offset
+	}
+}
+
+// consumeArgs returns the arguments for consuming the subscription's queue.
+func (o subscribeOptions) consumeArgs() amqp.Table {
+	if o.streamOffset == nil {
+		return nil
+	}
+	return amqp.Table{"x-stream-offset": o.streamOffset.value}
+}
@@ -0,0 +1,291 @@
+package pubsub
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestQueueArgs(t *testing.T) {
+	cases := []struct {
+		name      string
+		queueType SimpleQueueType
+		opts      []QueueOption
+		want      amqp.Table
+	}{
+		{"transient", SimpleQueueTransient, []QueueOption{WithDeadLetterExchange("dlx")}, amqp.Table{
+			"x-dead-letter-exchange": "dlx",
+		}},
+		{"durable", SimpleQueueDurable, []QueueOption{WithDeadLetterExchange("dlx")}, amqp.Table{
+			"x-dead-letter-exchange": "dlx",
+		}},
+		{"quorum", SimpleQueueQuorum, []QueueOption{WithDeadLetterExchange("dlx"), WithDeliveryLimit(5)}, amqp.Table{
+			"x-queue-type":           "quorum",
+			"x-delivery-limit":       int64(5),
+			"x-dead-letter-exchange": "dlx",
+		}},
+		{"delivery limit ignored without quorum", SimpleQueueDurable, []QueueOption{WithDeadLetterExchange("dlx"), WithDeliveryLimit(5)}, amqp.Table{
+			"x-dead-letter-exchange": "dlx",
+		}},
+		{"stream drops the dead-letter exchange", SimpleQueueStream, []QueueOption{WithDeadLetterExchange("dlx"), WithDeliveryLimit(5)}, amqp.Table{
+			"x-queue-type": "stream",
+		}},
+		{"default dead-letter exchange", SimpleQueueDurable, nil, amqp.Table{
+			"x-dead-letter-exchange": DeadLetterExchange,
+		}},
+		{"without a dead-letter exchange", SimpleQueueDurable, []QueueOption{WithDeadLetterExchange("")}, amqp.Table{}},
+		{"limits", SimpleQueueDurable, []QueueOption{WithMessageTTL(30 * time.Second), WithMaxLength(100, OverflowRejectPublish), WithMaxPriority(10)}, amqp.Table{
+			"x-message-ttl":          int64(30000),
+			"x-max-length":           int64(100),
+			"x-overflow":             "reject-publish",
+			"x-max-priority":         int64(10),
+			"x-dead-letter-exchange": DeadLetterExchange,
+		}},
+		{"stream drops the limits", SimpleQueueStream, []QueueOption{WithMessageTTL(time.Second), WithMaxLength(100, OverflowDropHead), WithMaxPriority(10)}, amqp.Table{
+			"x-queue-type": "stream",
+		}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := c.queueType.args(newQueueOptions(c.opts)); !reflect.DeepEqual(got, c.want) {
+				t.Errorf("args = %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestQueueFlags(t *testing.T) {
+	cases := []struct {
+		name                           string
+		queueType                      SimpleQueueType
+		durable, autoDelete, exclusive bool
+	}{
+		{"transient", SimpleQueueTransient, false, true, true},
+		{"durable", SimpleQueueDurable, true, false, false},
+		{"quorum", SimpleQueueQuorum, true, false, false},
+		{"stream", SimpleQueueStream, true, false, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			durable, autoDelete, exclusive := c.queueType.flags()
+			if durable != c.durable || autoDelete != c.autoDelete || exclusive != c.exclusive {
+				t.Errorf("flags = %v, %v, %v; want %v, %v, %v", durable, autoDelete, exclusive, c.durable, c.autoDelete, c.exclusive)
+			}
+		})
+	}
+}
+
+func TestDeliveryLimit(t *testing.T) {
+	for _, tb := range testBrokers(t) {
+		t.Run(tb.name, func(t *testing.T) {
+			conn := tb.connect(t)
+			exchange := declareTestExchange(t, conn, amqp.ExchangeDirect)
+			pub := newTestPublisher(t, conn)
+			dlx, dlq := declareDeadLetters(t, tb, conn)
+			queue := testName("queue")
+			tb.remove(t, queue)
+			var deliveries atomic.Int32
+			sub, err := Subscribe(testContext(t), conn, exchange, queue, "key", SimpleQueueQuorum, func(context.Context, string) AckType {
+				deliveries.Add(1)
+				return NackRequeue
+			}, WithQueueOptions(WithDeadLetterExchange(dlx), WithDeliveryLimit(2)), WithoutMiddleware())
+			if err != nil {
+				t.Fatalf("Subscribe: %v", err)
+			}
+			defer sub.Close()
+			if err := PublishJSON(context.Background(), pub, exchange, "key", "hello"); err != nil {
+				t.Fatalf("PublishJSON: %v", err)
+			}
+			getMessage(t, conn, dlq)
+			if got := deliveries.Load(); got != 3 {
+				t.Errorf("delivered %d times, want 3", got)
+			}
+		})
+	}
+}
+
+func TestQueueLimits(t *testing.T) {
+	cases := []struct {
+		name string
+		opts []QueueOption
+		// publish is the priority of each message published, in order.
+		publish []uint8
+		// expiration is set on every publish, if non-zero.
+		expiration time.Duration
+		// nacked is the number of publishes the broker refuses.
+		nacked int
+		// queued and deadLettered are the priorities left in the queue, in
+		// delivery order, and the ones that were dead-lettered.
+		queued, deadLettered []uint8
+	}{
+		{"message TTL", []QueueOption{WithMessageTTL(50 * time.Millisecond)}, []uint8{1, 2}, 0, 0, []uint8{}, []uint8{1, 2}},
+		{"expiration", nil, []uint8{1, 2}, 50 * time.Millisecond, 0, []uint8{}, []uint8{1, 2}},
+		{"priority", []QueueOption{WithMaxPriority(10)}, []uint8{1, 5, 3, 5}, 0, 0, []uint8{5, 5, 3, 1}, []uint8{}},
+		{"priority above the maximum", []QueueOption{WithMaxPriority(2)}, []uint8{1, 9, 2}, 0, 0, []uint8{9, 2, 1}, []uint8{}},
+		{"no maximum priority", nil, []uint8{1, 5, 3}, 0, 0, []uint8{1, 5, 3}, []uint8{}},
+		{"drop head", []QueueOption{WithMaxLength(2, OverflowDropHead)}, []uint8{1, 2, 3}, 0, 0, []uint8{2, 3}, []uint8{1}},
+		{"reject publish", []QueueOption{WithMaxLength(2, OverflowRejectPublish)}, []uint8{1, 2, 3}, 0, 1, []uint8{1, 2}, []uint8{}},
+		{"reject publish to the dead-letter exchange", []QueueOption{WithMaxLength(2, OverflowRejectPublishDLX)}, []uint8{1, 2, 3}, 0, 1, []uint8{1, 2}, []uint8{3}},
+	}
+	for _, tb := range testBrokers(t) {
+		t.Run(tb.name, func(t *testing.T) {
+			for _, c := range cases {
+				t.Run(c.name, func(t *testing.T) {
+					conn := tb.connect(t)
+					exchange := declareTestExchange(t, conn, amqp.ExchangeDirect)
+					pub := newTestPublisher(t, conn)
+					dlx, dlq := declareDeadLetters(t, tb, conn)
+					ch, q, err := DeclareAndBind(conn, exchange, testName("queue"), "key", SimpleQueueDurable, append([]QueueOption{WithDeadLetterExchange(dlx)}, c.opts...)...)
+					if err != nil {
+						t.Fatalf("DeclareAndBind: %v", err)
+					}
+					ch.Close()
+					tb.remove(t, q.Name)
+
+					nacked := 0
+					for _, p := range c.publish {
+						err := PublishJSON(context.Background(), pub, exchange, "key", p, WithPriority(p), WithExpiration(c.expiration))
+						if errors.Is(err, ErrNacked) {
+							nacked++
+						} else if err != nil {
+							t.Fatalf("PublishJSON: %v", err)
+						}
+					}
+					if nacked != c.nacked {
+						t.Errorf("%d publishes nacked, want %d", nacked, c.nacked)
+					}
+
+					// drain waits until queue holds as many messages as want
+					// and gets them, as the dead-lettered ones arrive later.
+					drain := func(queue string, want []uint8) []uint8 {
+						eventually(t, fmt.Sprintf("%s holds %d messages", queue, len(want)), func() bool {
+							return queueLen(t, conn, queue) == len(want)
+						})
+						got := []uint8{}
+						for range want {
+							var p uint8
+							if err := json.Unmarshal(getMessage(t, conn, queue).Body, &p); err != nil {
+								t.Fatalf("Unmarshal: %v", err)
+							}
+							got = append(got, p)
+						}
+						return got
+					}
+					if got := drain(q.Name, c.queued); !reflect.DeepEqual(got, c.queued) {
+						t.Errorf("queued %v, want %v", got, c.queued)
+					}
+					if got := drain(dlq, c.deadLettered); !reflect.DeepEqual(got, c.deadLettered) {
+						t.Errorf("dead-lettered %v, want %v", got, c.deadLettered)
+					}
+				})
+			}
+		})
+	}
+}
+
+func TestStreamOffsetArgs(t *testing.T) {
+	at := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	cases := []struct {
+		name   string
+		offset *StreamOffset
+		want   amqp.Table
+	}{
+		{"none", nil, nil},
+		{"first", &StreamOffsetFirst, amqp.Table{"x-stream-offset": "first"}},
+		{"last", &StreamOffsetLast, amqp.Table{"x-stream-offset": "last"}},
+		{"next", &StreamOffsetNext, amqp.Table{"x-stream-offset": "next"}},
+		{"time", ptr(StreamOffsetAt(at)), amqp.Table{"x-stream-offset": at}},
+		{"number", ptr(StreamOffsetNumber(42)), amqp.Table{"x-stream-offset": int64(42)}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			options := subscribeOptions{streamOffset: c.offset}
+			if got := options.consumeArgs(); !reflect.DeepEqual(got, c.want) {
+				t.Errorf("consumeArgs = %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func TestStreamRejectsRetry(t *testing.T) {
+	conn := NewMemoryBroker().Connect()
+	defer conn.Close()
+	_, err := Subscribe(testContext(t), conn, "", testName("stream"), "key", SimpleQueueStream, func(context.Context, string) AckType {
+		return Ack
+	}, WithRetry(RetryPolicy{MaxAttempts: 3}))
+	if !errors.Is(err, errStreamRetry) {
+		t.Errorf("Subscribe = %v, want errStreamRetry", err)
+	}
+}
+
+func TestStreamOffset(t *testing.T) {
+	cases := []struct {
+		name   string
+		offset StreamOffset
+		want   string
+	}{
+		{"first", StreamOffsetFirst, "[0 1 2 3]"},
+		{"next", StreamOffsetNext, "[3]"},
+		{"number", StreamOffsetNumber(1), "[1 2 3]"},
+	}
+	for _, tb := range testBrokers(t) {
+		t.Run(tb.name, func(t *testing.T) {
+			if tb.name == "memory" {
+				t.Skip("MemoryBroker does not support streams")
+			}
+			conn := tb.connect(t)
+			exchange := declareTestExchange(t, conn, amqp.ExchangeDirect)
+			pub := newTestPublisher(t, conn)
+			stream := testName("stream")
+			tb.remove(t, stream)
+			ch, _, err := DeclareAndBind(conn, exchange, stream, "key", SimpleQueueStream)
+			if err != nil {
+				t.Fatalf("DeclareAndBind: %v", err)
+			}
+			ch.Close()
+			for i := 0; i < 3; i++ {
+				if err := PublishJSON(context.Background(), pub, exchange, "key", i); err != nil {
+					t.Fatalf("PublishJSON: %v", err)
+				}
+			}
+			for _, c := range cases {
+				t.Run(c.name, func(t *testing.T) {
+					values := make(chan int, 4)
+					sub, err := Subscribe(testContext(t), conn, exchange, stream, "key", SimpleQueueStream, func(_ context.Context, i int) AckType {
+						values <- i
+						return Ack
+					}, WithStreamOffset(c.offset), WithoutMiddleware())
+					if err != nil {
+						t.Fatalf("Subscribe: %v", err)
+					}
+					defer sub.Close()
+					// A message published once the consumer has started is
+					// read whatever the offset
+					time.Sleep(100 * time.Millisecond)
+					if err := PublishJSON(context.Background(), pub, exchange, "key", 3); err != nil {
+						t.Fatalf("PublishJSON: %v", err)
+					}
+					var got []int
+					for v := -1; v != 3; {
+						v = receive(t, values)
+						got = append(got, v)
+					}
+					if fmt.Sprint(got) != c.want {
+						t.Errorf("read %v, want %s", got, c.want)
+					}
+				})
+			}
+		})
+	}
+}
@@ -0,0 +1,142 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	// RetryCountHeader counts how many times a message has been sent back
+	// through a retry queue.
+	RetryCountHeader = "x-retry-count"
+	// OriginalExchangeHeader and OriginalRoutingKeyHeader keep where a retried
+	// message was first published, since retries reach the queue through the
+	// default exchange.
+	OriginalExchangeHeader   = "x-original-exchange"
+	OriginalRoutingKeyHeader = "x-original-routing-key"
+)
+
+// RetryPolicy turns NackRequeue into a delayed redelivery. Instead of going
+// straight back to the head of the queue, the message is parked in a retry
+// queue whose TTL dead-letters it back to the main queue after the delay.
+// Once MaxAttempts deliveries have failed the message is rejected to the
+// dead-letter exchange.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of deliveries, including the first.
+	// With one or fewer, failed messages are dead-lettered straight away.
+	MaxAttempts int
+	// InitialDelay is the wait before the first retry; each later retry
+	// waits twice as long as the one before, up to MaxDelay.
+	InitialDelay time.Duration
+	// MaxDelay caps the wait between retries. Zero means no cap.
+	MaxDelay time.Duration
+}
+
+// WithRetry enables delayed retries for handlers that return NackRequeue.
+func WithRetry(policy RetryPolicy) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.retry = &policy
+	}
+}
+
+// RetryCount reads RetryCountHeader, returning 0 for a first delivery.
+func RetryCount(headers amqp.Table) int {
+	n, _ := intArg(headers, RetryCountHeader)
+	return int(n)
+}
+
+// delay returns how long to wait before retry number attempt (1-based).
+func (p RetryPolicy) delay(attempt int) time.Duration {
+	d := p.InitialDelay
+	for i := 1; i < attempt && (p.MaxDelay <= 0 || d < p.MaxDelay) && d < math.MaxInt64/2; i++ {
+		d *= 2
+	}
+	if p.MaxDelay > 0 && d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	return d
+}
+
+func retryQueueName(queue string, delay time.Duration) string {
+	return fmt.Sprintf("%s.retry.%dms", queue, delay.Milliseconds())
+}
+
+// declareRetryQueues declares one retry queue per distinct delay. Retry
+// queues have no consumers; expired messages are dead-lettered through the
+// default exchange straight back to queue.
+func (p RetryPolicy) declareRetryQueues(ch Channel, queue string, simpleQueueType SimpleQueueType) error {
+	durable := simpleQueueType != SimpleQueueTransient
+	declared := map[time.Duration]bool{}
+	for attempt := 1; attempt < p.MaxAttempts; attempt++ {
+		delay := p.delay(attempt)
+		if declared[delay] {
+			continue
+		}
+		declared[delay] = true
+		_, err := ch.QueueDeclare(
+			retryQueueName(queue, delay),
+			durable,  // durable
+			false,    // delete when unused
+			!durable, // exclusive
+			false,    // no-wait
+			amqp.Table{
+				"x-message-ttl":             delay.Milliseconds(),
+				"x-dead-letter-exchange":    "",
+				"x-dead-letter-routing-key": queue,
+			},
+		)
+		if err != nil {
+			return fmt.Errorf("could not declare retry queue: %v", err)
+		}
+	}
+	return nil
+}
+
+// retry parks delivery in the retry queue for its next attempt and returns
+// the AckType to settle the original delivery with: Ack once the copy is
+// parked, NackDiscard when attempts are exhausted, or NackRequeue if the copy
+// could not be published.
+func (p RetryPolicy) retry(ch Publisher, queue string, delivery amqp.Delivery) AckType {
+	attempt := RetryCount(delivery.Headers) + 1
+	if attempt >= p.MaxAttempts {
+		log.Printf("giving up on message from %q after %d attempts", queue, attempt)
+		return NackDiscard
+	}
+
+	headers := copyTable(delivery.Headers)
+	if headers == nil {
+		headers = amqp.Table{}
+	}
+	headers[RetryCountHeader] = int32(attempt)
+	if _, ok := headers[OriginalRoutingKeyHeader]; !ok {
+		headers[OriginalExchangeHeader] = delivery.Exchange
+		headers[OriginalRoutingKeyHeader] = delivery.RoutingKey
+	}
+	msg := amqp.Publishing{
+		Headers:         headers,
+		ContentType:     delivery.ContentType,
+		ContentEncoding: delivery.ContentEncoding,
+		DeliveryMode:    delivery.DeliveryMode,
+		Priority:        delivery.Priority,
+		CorrelationId:   delivery.CorrelationId,
+		ReplyTo:         delivery.ReplyTo,
+		MessageId:       delivery.MessageId,
+		Timestamp:       delivery.Timestamp,
+		Type:            delivery.Type,
+		AppId:           delivery.AppId,
+		Body:            delivery.Body,
+	}
+	delay := p.delay(attempt)
+	err := ch.PublishWithContext(context.Background(), "", retryQueueName(queue, delay), false, false, msg)
+	if err != nil {
+		fmt.Printf("failed to schedule retry: %v\n", err)
+		return NackRequeue
+	}
+	log.Printf("retrying message from %q in %s (attempt %d of %d)", queue, delay, attempt+1, p.MaxAttempts)
+	return Ack
+}
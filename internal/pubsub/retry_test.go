@@ -0,0 +1,84 @@
+package pubsub
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestRetryPolicyDelay(t *testing.T) {
+	cases := []struct {
+		name    string
+		policy  RetryPolicy
+		attempt int
+		want    time.Duration
+	}{
+		{"first retry", RetryPolicy{InitialDelay: time.Second}, 1, time.Second},
+		{"doubles", RetryPolicy{InitialDelay: time.Second}, 3, 4 * time.Second},
+		{"capped", RetryPolicy{InitialDelay: time.Second, MaxDelay: 3 * time.Second}, 3, 3 * time.Second},
+		{"zero MaxDelay is no cap", RetryPolicy{InitialDelay: time.Second}, 10, 512 * time.Second},
+		{"does not overflow", RetryPolicy{InitialDelay: time.Second}, 100, time.Second << 33},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := c.policy.delay(c.attempt); got != c.want {
+				t.Errorf("delay(%d) = %v, want %v", c.attempt, got, c.want)
+			}
+		})
+	}
+}
+
+func TestRetryEndsInDeadLetterQueue(t *testing.T) {
+	cases := []struct {
+		name     string
+		policy   RetryPolicy
+		attempts int
+	}{
+		{"no retries", RetryPolicy{MaxAttempts: 1}, 1},
+		{"three attempts", RetryPolicy{MaxAttempts: 3, InitialDelay: 20 * time.Millisecond}, 3},
+		{"capped delay", RetryPolicy{MaxAttempts: 4, InitialDelay: 20 * time.Millisecond, MaxDelay: 30 * time.Millisecond}, 4},
+	}
+	for _, tb := range testBrokers(t) {
+		t.Run(tb.name, func(t *testing.T) {
+			conn := tb.connect(t)
+			exchange := declareTestExchange(t, conn, amqp.ExchangeTopic)
+			pub := newTestPublisher(t, conn)
+			for _, c := range cases {
+				t.Run(c.name, func(t *testing.T) {
+					dlx, dlq := declareDeadLetters(t, tb, conn)
+					queue := testName("queue")
+					tb.remove(t, queue)
+					for attempt := 1; attempt < c.policy.MaxAttempts; attempt++ {
+						tb.remove(t, retryQueueName(queue, c.policy.delay(attempt)))
+					}
+					var attempts atomic.Int32
+					sub, err := Subscribe(testContext(t), conn, exchange, queue, "war.*", SimpleQueueDurable, func(context.Context, string) AckType {
+						attempts.Add(1)
+						return NackRequeue
+					}, WithRetry(c.policy), WithQueueOptions(WithDeadLetterExchange(dlx)), WithoutMiddleware())
+					if err != nil {
+						t.Fatalf("Subscribe: %v", err)
+					}
+					defer sub.Close()
+
+					if err := PublishJSON(context.Background(), pub, exchange, "war.alice", "hello"); err != nil {
+						t.Fatalf("PublishJSON: %v", err)
+					}
+					d := getMessage(t, conn, dlq)
+					if got := int(attempts.Load()); got != c.attempts {
+						t.Errorf("handled %d times, want %d", got, c.attempts)
+					}
+					if got := RetryCount(d.Headers); got != c.attempts-1 {
+						t.Errorf("RetryCount = %d, want %d", got, c.attempts-1)
+					}
+					if _, key, _ := Origin(d.Headers); key != "war.alice" {
+						t.Errorf("Origin key = %q, want %q", key, "war.alice")
+					}
+				})
+			}
+		})
+	}
+}
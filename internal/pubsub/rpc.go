@@ -0,0 +1,219 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// RPCErrorHeader carries the error returned by a responder's handler, in
+// place of a reply body.
+const RPCErrorHeader = "x-rpc-error"
+
+// ErrNoResponder is returned by Request when no queue is bound for the
+// request's exchange and routing key.
+var ErrNoResponder = errors.New("pubsub: no responder for request")
+
+// RemoteError is returned by Request when the responder's handler failed.
+type RemoteError struct {
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return "pubsub: responder failed: " + e.Message
+}
+
+// RPCClient sends requests made with Request and routes each reply back to
+// its caller by correlation ID. Replies arrive on an exclusive callback
+// queue owned by the client. It is safe for concurrent use.
+type RPCClient struct {
+	ch    Channel
+	queue string
+
+	mu      sync.Mutex
+	pending map[string]chan rpcResult
+	closed  error
+}
+
+type rpcResult struct {
+	reply amqp.Delivery
+	err   error
+}
+
+// NewRPCClient opens a channel on conn and declares the client's callback
+// queue.
+func NewRPCClient(conn Broker) (*RPCClient, error) {
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+	queue := "rpc.reply." + newMessageID()
+	_, err = ch.QueueDeclare(
+		queue,
+		false, // durable
+		true,  // delete when unused
+		true,  // exclusive
+		false, // no-wait
+		nil,
+	)
+	if err != nil {
+		ch.Close()
+		return nil, fmt.Errorf("could not declare callback queue: %w", err)
+	}
+	replies, err := ch.Consume(queue, "", true, true, false, false, nil)
+	if err != nil {
+		ch.Close()
+		return nil, fmt.Errorf("could not consume callback queue: %w", err)
+	}
+	c := &RPCClient{
+		ch:      ch,
+		queue:   queue,
+		pending: map[string]chan rpcResult{},
+	}
+	returns := ch.NotifyReturn(make(chan amqp.Return, 16))
+	go c.listen(replies, returns)
+	return c, nil
+}
+
+// Close closes the client's channel. Requests still waiting fail.
+func (c *RPCClient) Close() error {
+	return c.ch.Close()
+}
+
+// Request publishes req to exchange with key and waits for the reply, which
+// is decoded into Resp with the codec matching its content type. ctx bounds
+// the wait; a reply arriving after it is done is dropped.
+func Request[Req, Resp any](ctx context.Context, c *RPCClient, exchange, key string, req Req, opts ...PublishOption) (Resp, error) {
+	var resp Resp
+	options := newPublishOptions(opts)
+	id := newMessageID()
+	msg, err := encode(Envelope[Req]{Value: req, CorrelationID: id, ReplyTo: c.queue}, options)
+	if err != nil {
+		return resp, err
+	}
+
+	result, err := c.await(id)
+	if err != nil {
+		return resp, err
+	}
+	defer c.forget(id)
+	if err := publish(ctx, c.ch, exchange, key, true, msg); err != nil {
+		return resp, err
+	}
+
+	select {
+	case r := <-result:
+		if r.err != nil {
+			return resp, r.err
+		}
+		if remote, ok := r.reply.Headers[RPCErrorHeader].(string); ok {
+			return resp, &RemoteError{Message: remote}
+		}
+		codec, err := codecForDelivery(r.reply.ContentType, options.codec)
+		if err != nil {
+			return resp, err
+		}
+		return resp, codec.Unmarshal(r.reply.Body, &resp)
+	case <-ctx.Done():
+		return resp, fmt.Errorf("pubsub: no reply to request: %w", ctx.Err())
+	}
+}
+
+func (c *RPCClient) await(id string) (<-chan rpcResult, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed != nil {
+		return nil, c.closed
+	}
+	result := make(chan rpcResult, 1)
+	c.pending[id] = result
+	return result, nil
+}
+
+func (c *RPCClient) forget(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.pending, id)
+}
+
+func (c *RPCClient) resolve(id string, r rpcResult) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if result, ok := c.pending[id]; ok {
+		result <- r
+		delete(c.pending, id)
+	}
+}
+
+func (c *RPCClient) listen(replies <-chan amqp.Delivery, returns <-chan amqp.Return) {
+	for replies != nil {
+		select {
+		case d, ok := <-replies:
+			if !ok {
+				replies = nil
+				continue
+			}
+			c.resolve(d.CorrelationId, rpcResult{reply: d})
+		case r, ok := <-returns:
+			if !ok {
+				returns = nil
+				continue
+			}
+			c.resolve(r.CorrelationId, rpcResult{err: ErrNoResponder})
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = amqp.ErrClosed
+	for id, result := range c.pending {
+		result <- rpcResult{err: amqp.ErrClosed}
+		delete(c.pending, id)
+	}
+}
+
+// Serve answers requests sent with Request. It subscribes like Subscribe
+// and publishes whatever handler returns to the request's reply queue; an
+// error is sent back as a RemoteError. Requests published without a reply
+// queue are handled and acknowledged without a reply.
+func Serve[Req, Resp any](ctx context.Context, conn Broker, exchange, queueName, key string, simpleQueueType SimpleQueueType, handler func(context.Context, Req) (Resp, error), opts ...SubscribeOption) (*Subscription, error) {
+	replyCh, err := conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+	sub, err := subscribe(ctx, conn, exchange, queueName, key, simpleQueueType, func(ctx context.Context, req Req, meta Metadata) AckType {
+		resp, err := handler(ctx, req)
+		if meta.ReplyTo == "" {
+			return Ack
+		}
+		codec, ok := CodecFor(meta.ContentType)
+		if !ok {
+			codec = JSON
+		}
+		env := Envelope[Resp]{Value: resp, CorrelationID: meta.CorrelationID}
+		if err != nil {
+			env = Envelope[Resp]{CorrelationID: meta.CorrelationID, Headers: amqp.Table{RPCErrorHeader: err.Error()}}
+		}
+		msg, err := env.publishing(codec)
+		if err != nil {
+			msg, _ = Envelope[Resp]{CorrelationID: meta.CorrelationID, Headers: amqp.Table{RPCErrorHeader: err.Error()}}.publishing(codec)
+		}
+		if err := publish(ctx, replyCh, "", meta.ReplyTo, false, msg); err != nil {
+			fmt.Printf("failed to reply to %s: %v\n", meta.ReplyTo, err)
+			return NackRequeue
+		}
+		return Ack
+	}, opts...)
+	if err != nil {
+		replyCh.Close()
+		return nil, err
+	}
+	go func() {
+		sub.Wait()
+		replyCh.Close()
+	}()
+	return sub, nil
+}
@@ -0,0 +1,122 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestRequest(t *testing.T) {
+	cases := []struct {
+		name string
+		key  string
+		req  string
+		// check reports what is wrong with the reply, if anything.
+		check func(resp int, err error) string
+	}{
+		{"reply", "len", "hello", func(resp int, err error) string {
+			if err != nil || resp != 5 {
+				return "want 5"
+			}
+			return ""
+		}},
+		{"handler fails", "len", "fail", func(_ int, err error) string {
+			var remote *RemoteError
+			if !errors.As(err, &remote) || remote.Message != "cannot measure fail" {
+				return "want a *RemoteError with the handler's message"
+			}
+			return ""
+		}},
+		{"no responder", "unbound", "hello", func(_ int, err error) string {
+			if !errors.Is(err, ErrNoResponder) {
+				return "want ErrNoResponder"
+			}
+			return ""
+		}},
+		{"no reply in time", "len", "slow", func(_ int, err error) string {
+			if !errors.Is(err, context.DeadlineExceeded) {
+				return "want context.DeadlineExceeded"
+			}
+			return ""
+		}},
+	}
+	for _, tb := range testBrokers(t) {
+		t.Run(tb.name, func(t *testing.T) {
+			conn := tb.connect(t)
+			exchange := declareTestExchange(t, conn, amqp.ExchangeDirect)
+			release := make(chan struct{})
+			sub, err := Serve(testContext(t), conn, exchange, "", "len", SimpleQueueTransient, func(_ context.Context, req string) (int, error) {
+				switch req {
+				case "fail":
+					return 0, errors.New("cannot measure fail")
+				case "slow":
+					<-release
+				}
+				return len(req), nil
+			}, WithoutMiddleware())
+			if err != nil {
+				t.Fatalf("Serve: %v", err)
+			}
+			defer sub.Close()
+			defer close(release)
+			client, err := NewRPCClient(conn)
+			if err != nil {
+				t.Fatalf("NewRPCClient: %v", err)
+			}
+			defer client.Close()
+
+			for _, c := range cases {
+				t.Run(c.name, func(t *testing.T) {
+					ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+					defer cancel()
+					resp, err := Request[string, int](ctx, client, exchange, c.key, c.req)
+					if problem := c.check(resp, err); problem != "" {
+						t.Errorf("Request = %d, %v; %s", resp, err, problem)
+					}
+				})
+			}
+		})
+	}
+}
+
+func TestRequestFailsWhenClientCloses(t *testing.T) {
+	for _, tb := range testBrokers(t) {
+		t.Run(tb.name, func(t *testing.T) {
+			conn := tb.connect(t)
+			exchange := declareTestExchange(t, conn, amqp.ExchangeDirect)
+			started := make(chan struct{})
+			release := make(chan struct{})
+			sub, err := Serve(testContext(t), conn, exchange, "", "len", SimpleQueueTransient, func(_ context.Context, req string) (int, error) {
+				close(started)
+				<-release
+				return len(req), nil
+			}, WithoutMiddleware())
+			if err != nil {
+				t.Fatalf("Serve: %v", err)
+			}
+			defer sub.Close()
+			defer close(release)
+			client, err := NewRPCClient(conn)
+			if err != nil {
+				t.Fatalf("NewRPCClient: %v", err)
+			}
+
+			errs := make(chan error, 1)
+			go func() {
+				_, err := Request[string, int](context.Background(), client, exchange, "len", "hello")
+				errs <- err
+			}()
+			receive(t, started)
+			client.Close()
+			if err := receive(t, errs); !errors.Is(err, amqp.ErrClosed) {
+				t.Errorf("Request = %v, want amqp.ErrClosed", err)
+			}
+			if _, err := Request[string, int](context.Background(), client, exchange, "len", "hello"); err == nil {
+				t.Error("Request on a closed client succeeded")
+			}
+		})
+	}
+}
@@ -0,0 +1,285 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	// ScheduledQueue receives delayed messages once they are due, for the
+	// Scheduler to forward.
+	ScheduledQueue = "peril_scheduled"
+	// ScheduledExchangeHeader and ScheduledRoutingKeyHeader keep where a
+	// delayed message is to be published once it is due.
+	ScheduledExchangeHeader   = "x-scheduled-exchange"
+	ScheduledRoutingKeyHeader = "x-scheduled-routing-key"
+	// scheduledExpirationHeader holds the message's own expiration while it
+	// waits, since it would otherwise cut the wait short.
+	scheduledExpirationHeader = "x-scheduled-expiration"
+	// scheduledAttemptsHeader counts the failed attempts to forward a due
+	// message.
+	scheduledAttemptsHeader = "x-scheduled-attempts"
+	// cancelRetention is how long a cancellation is kept for a message that
+	// never shows up.
+	cancelRetention = 24 * time.Hour
+	// A due message that cannot be forwarded waits again, for a delay that
+	// doubles from minForwardBackoff up to maxForwardBackoff with every
+	// attempt.
+	minForwardBackoff = 500 * time.Millisecond
+	maxForwardBackoff = 30 * time.Second
+)
+
+// Scheduler publishes messages after a delay without any broker plugin.
+// PublishDelayed parks a message in a queue whose TTL is the delay; when it
+// expires it is dead-lettered to ScheduledQueue, and the Scheduler forwards
+// it to its exchange and routing key. Messages that come due while no
+// Scheduler runs wait in ScheduledQueue for the next one.
+type Scheduler struct {
+	ch      Channel
+	sub     *Subscription
+	store   DedupeStore
+	closing chan struct{}
+	close   sync.Once
+
+	mu       sync.Mutex
+	canceled map[string]time.Time
+}
+
+// NewScheduler declares ScheduledQueue and starts forwarding due messages
+// until ctx is done or the scheduler is closed. Cancellations are kept in
+// store, so they still apply after a restart; with a nil store they are kept
+// in memory only.
+func NewScheduler(ctx context.Context, conn Broker, store DedupeStore) (*Scheduler, error) {
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+	_, err = ch.QueueDeclare(ScheduledQueue, true, false, false, false, nil)
+	if err != nil {
+		ch.Close()
+		return nil, fmt.Errorf("could not declare scheduled queue: %v", err)
+	}
+	tag := "ctag-" + newMessageID()
+	deliveries, err := ch.Consume(ScheduledQueue, tag, false, false, false, false, nil)
+	if err != nil {
+		ch.Close()
+		return nil, err
+	}
+	s := &Scheduler{
+		ch:       ch,
+		sub:      newSubscription(ctx, ch, tag),
+		store:    store,
+		closing:  make(chan struct{}),
+		canceled: map[string]time.Time{},
+	}
+	go func() {
+		backoff := minForwardBackoff
+		for d := range deliveries {
+			if s.forward(d) {
+				backoff = minForwardBackoff
+				continue
+			}
+			// It could not even be parked again; wait before it comes back
+			// instead of spinning while the broker is unavailable
+			select {
+			case <-time.After(backoff):
+			case <-s.closing:
+			}
+			settle(d, NackRequeue)
+			backoff = min(2*backoff, maxForwardBackoff)
+		}
+		s.sub.stop()
+	}()
+	return s, nil
+}
+
+// Close stops forwarding and closes the scheduler's channel. Messages still
+// waiting are forwarded by the next Scheduler.
+func (s *Scheduler) Close() error {
+	s.close.Do(func() { close(s.closing) })
+	return s.sub.Close()
+}
+
+// PublishDelayed encodes val like Publish and publishes it to exchange with
+// key once delay has passed. It returns the message ID, which Cancel takes.
+// An expiration set with WithExpiration starts counting once the message is
+// forwarded.
+func PublishDelayed[T any](ctx context.Context, s *Scheduler, exchange, key string, val T, delay time.Duration, opts ...PublishOption) (string, error) {
+	msg, err := encode(Envelope[T]{Value: val}, newPublishOptions(opts))
+	if err != nil {
+		return "", err
+	}
+	msg.Headers = copyTable(msg.Headers)
+	if msg.Headers == nil {
+		msg.Headers = amqp.Table{}
+	}
+	msg.Headers[ScheduledExchangeHeader] = exchange
+	msg.Headers[ScheduledRoutingKeyHeader] = key
+	if msg.Expiration != "" {
+		msg.Headers[scheduledExpirationHeader] = msg.Expiration
+		msg.Expiration = ""
+	}
+
+	queue, err := s.declareDelayQueue(delay)
+	if err != nil {
+		return "", err
+	}
+	if err := publish(ctx, s.ch, "", queue, false, msg); err != nil {
+		return "", err
+	}
+	return msg.MessageId, nil
+}
+
+// Cancel stops the delayed message with the given ID from being published,
+// if it has not been already. Without a store, cancellations are kept in
+// memory and are lost if the scheduler closes before the message is due.
+func (s *Scheduler) Cancel(id string) error {
+	if s.store != nil {
+		return s.store.Mark(id, time.Now().Add(cancelRetention))
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for canceled, forget := range s.canceled {
+		if now.After(forget) {
+			delete(s.canceled, canceled)
+		}
+	}
+	s.canceled[id] = now.Add(cancelRetention)
+	return nil
+}
+
+// declareDelayQueue declares the queue holding messages delayed by delay.
+// Delay queues delete themselves once nothing has been scheduled on them
+// for a minute longer than their delay.
+func (s *Scheduler) declareDelayQueue(delay time.Duration) (string, error) {
+	ms := max(delay.Milliseconds(), 0)
+	name := fmt.Sprintf("peril_delay.%dms", ms)
+	_, err := s.ch.QueueDeclare(
+		name,
+		true,  // durable
+		false, // delete when unused
+		false, // exclusive
+		false, // no-wait
+		amqp.Table{
+			"x-message-ttl":             ms,
+			"x-expires":                 ms + time.Minute.Milliseconds(),
+			"x-dead-letter-exchange":    "",
+			"x-dead-letter-routing-key": ScheduledQueue,
+		},
+	)
+	if err != nil {
+		return "", fmt.Errorf("could not declare delay queue: %v", err)
+	}
+	return name, nil
+}
+
+// forward publishes a due message to where it was scheduled for, without
+// the headers that dead-lettering it added, and reports whether it settled
+// the delivery. A message that cannot be published is parked in a delay queue
+// to be tried again later, so it does not hold up the messages behind it; if
+// that fails too it is left for the caller to requeue.
+func (s *Scheduler) forward(d amqp.Delivery) bool {
+	if s.takeCanceled(d.MessageId) {
+		log.Printf("dropping canceled scheduled message %s", d.MessageId)
+		settle(d, Ack)
+		return true
+	}
+	exchange, _ := d.Headers[ScheduledExchangeHeader].(string)
+	key, _ := d.Headers[ScheduledRoutingKeyHeader].(string)
+	headers := withoutDeathHeaders(d.Headers)
+	for k := range headers {
+		if strings.HasPrefix(k, "x-scheduled-") {
+			delete(headers, k)
+		}
+	}
+	expiration, _ := d.Headers[scheduledExpirationHeader].(string)
+	msg := amqp.Publishing{
+		Headers:         headers,
+		ContentType:     d.ContentType,
+		ContentEncoding: d.ContentEncoding,
+		DeliveryMode:    d.DeliveryMode,
+		Priority:        d.Priority,
+		CorrelationId:   d.CorrelationId,
+		ReplyTo:         d.ReplyTo,
+		Expiration:      expiration,
+		MessageId:       d.MessageId,
+		Timestamp:       d.Timestamp,
+		Type:            d.Type,
+		AppId:           d.AppId,
+		Body:            d.Body,
+	}
+	if err := publish(s.sub.ctx, s.ch, exchange, key, false, msg); err != nil {
+		attempts, _ := intArg(d.Headers, scheduledAttemptsHeader)
+		delay := minForwardBackoff
+		for i := int64(0); i < attempts && delay < maxForwardBackoff; i++ {
+			delay *= 2
+		}
+		delay = min(delay, maxForwardBackoff)
+		log.Printf("could not forward scheduled message %s, trying again in %v: %v", d.MessageId, delay, err)
+		if err := s.park(d, attempts+1, delay); err != nil {
+			fmt.Printf("failed to park scheduled message: %v\n", err)
+			return false
+		}
+	}
+	settle(d, Ack)
+	return true
+}
+
+// park puts a due message back in a delay queue to come due again after
+// delay.
+func (s *Scheduler) park(d amqp.Delivery, attempts int64, delay time.Duration) error {
+	headers := withoutDeathHeaders(d.Headers)
+	headers[scheduledAttemptsHeader] = attempts
+	queue, err := s.declareDelayQueue(delay)
+	if err != nil {
+		return err
+	}
+	return publish(s.sub.ctx, s.ch, "", queue, false, amqp.Publishing{
+		Headers:         headers,
+		ContentType:     d.ContentType,
+		ContentEncoding: d.ContentEncoding,
+		DeliveryMode:    d.DeliveryMode,
+		Priority:        d.Priority,
+		CorrelationId:   d.CorrelationId,
+		ReplyTo:         d.ReplyTo,
+		MessageId:       d.MessageId,
+		Timestamp:       d.Timestamp,
+		Type:            d.Type,
+		AppId:           d.AppId,
+		Body:            d.Body,
+	})
+}
+
+// withoutDeathHeaders copies headers without those dead-lettering added.
+func withoutDeathHeaders(headers amqp.Table) amqp.Table {
+	out := amqp.Table{}
+	for k, v := range headers {
+		if k == "x-death" || strings.HasPrefix(k, "x-first-death-") || strings.HasPrefix(k, "x-last-death-") {
+			continue
+		}
+		out[k] = v
+	}
+	return out
+}
+
+func (s *Scheduler) takeCanceled(id string) bool {
+	if s.store != nil {
+		canceled, err := s.store.Seen(id)
+		if err != nil {
+			log.Printf("could not check whether scheduled message %s was canceled: %v", id, err)
+		}
+		return canceled
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.canceled[id]
+	delete(s.canceled, id)
+	return ok
+}
@@ -0,0 +1,100 @@
+package pubsub
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestScheduler(t *testing.T) {
+	cases := []struct {
+		name   string
+		cancel bool
+		// store keeps cancellations in an outbox rather than in memory.
+		store bool
+		// restart closes the scheduler after the publish and forwards with
+		// a new one.
+		restart bool
+		want    []string
+	}{
+		{"delivered", false, false, false, []string{"scheduled", "last"}},
+		{"canceled", true, false, false, []string{"last"}},
+		{"delivered after a restart", false, true, true, []string{"scheduled", "last"}},
+		{"canceled before a restart", true, true, true, []string{"last"}},
+	}
+	for _, tb := range testBrokers(t) {
+		t.Run(tb.name, func(t *testing.T) {
+			conn := tb.connect(t)
+			for _, c := range cases {
+				t.Run(c.name, func(t *testing.T) {
+					exchange := declareTestExchange(t, conn, amqp.ExchangeDirect)
+					received := make(chan string, 2)
+					sub, err := Subscribe(testContext(t), conn, exchange, "", "key", SimpleQueueTransient, func(_ context.Context, s string) AckType {
+						received <- s
+						return Ack
+					}, WithoutMiddleware())
+					if err != nil {
+						t.Fatalf("Subscribe: %v", err)
+					}
+					defer sub.Close()
+
+					path := filepath.Join(t.TempDir(), "scheduler.outbox")
+					// newScheduler starts a scheduler and returns it with a
+					// function that closes it and its store
+					newScheduler := func() (*Scheduler, func()) {
+						var outbox *Outbox
+						var store DedupeStore
+						if c.store {
+							outbox, err = OpenOutbox(path)
+							if err != nil {
+								t.Fatalf("OpenOutbox: %v", err)
+							}
+							store = outbox
+						}
+						s, err := NewScheduler(testContext(t), conn, store)
+						if err != nil {
+							t.Fatalf("NewScheduler: %v", err)
+						}
+						return s, func() {
+							s.Close()
+							if outbox != nil {
+								outbox.Close()
+							}
+						}
+					}
+
+					s, stop := newScheduler()
+					defer func() { stop() }()
+					id, err := PublishDelayed(context.Background(), s, exchange, "key", "scheduled", 100*time.Millisecond)
+					if err != nil {
+						t.Fatalf("PublishDelayed: %v", err)
+					}
+					if c.cancel {
+						if err := s.Cancel(id); err != nil {
+							t.Fatalf("Cancel: %v", err)
+						}
+					}
+					if c.restart {
+						stop()
+						s, stop = newScheduler()
+					}
+					// Forwarded in order of their delays, so once "last"
+					// arrives "scheduled" has been forwarded or dropped
+					if _, err := PublishDelayed(context.Background(), s, exchange, "key", "last", 300*time.Millisecond); err != nil {
+						t.Fatalf("PublishDelayed: %v", err)
+					}
+					var got []string
+					for len(got) == 0 || got[len(got)-1] != "last" {
+						got = append(got, receive(t, received))
+					}
+					if len(got) != len(c.want) || got[0] != c.want[0] {
+						t.Errorf("received %q, want %q", got, c.want)
+					}
+				})
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Subscription is a running consumer started by Subscribe and friends.
+type Subscription struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	ch     Channel
+	tag    string
+	done   chan struct{}
+	close  sync.Once
+
+	mu  sync.Mutex
+	err error
+}
+
+func newSubscription(ctx context.Context, ch Channel, tag string) *Subscription {
+	s := &Subscription{ch: ch, tag: tag, done: make(chan struct{})}
+	// Handlers keep their context until the subscription has stopped, so
+	// cancelling ctx lets them finish instead of failing their publishes
+	s.ctx, s.cancel = context.WithCancel(context.WithoutCancel(ctx))
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.Close()
+		case <-s.done:
+		}
+	}()
+	return s
+}
+
+// Close cancels the consumer, waits for the deliveries already received to
+// be handled and settled, then closes the subscription's channel. Messages
+// the broker had not yet delivered stay in the queue. The context passed to
+// handlers is only cancelled once they have all returned.
+func (s *Subscription) Close() error {
+	s.close.Do(func() {
+		if err := s.ch.Cancel(s.tag, false); err != nil && !errors.Is(err, amqp.ErrClosed) {
+			// Closing the channel ends the deliveries instead
+			s.setErr(err)
+			s.ch.Close()
+		}
+	})
+	<-s.done
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// Wait blocks until the subscription has stopped, either through Close,
+// cancellation of its context or the loss of its channel.
+func (s *Subscription) Wait() {
+	<-s.done
+}
+
+// Done is closed once the subscription has stopped.
+func (s *Subscription) Done() <-chan struct{} {
+	return s.done
+}
+
+// stop is called once the consumer's deliveries have all been handled.
+func (s *Subscription) stop() {
+	if err := s.ch.Close(); err != nil && !errors.Is(err, amqp.ErrClosed) {
+		s.setErr(err)
+	}
+	s.cancel()
+	close(s.done)
+}
+
+func (s *Subscription) setErr(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err == nil {
+		s.err = err
+	}
+}
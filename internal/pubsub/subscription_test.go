@@ -0,0 +1,82 @@
+package pubsub
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestSubscriptionStopDrainsHandlers(t *testing.T) {
+	cases := []struct {
+		name string
+		// stop stops sub, whose context is cancelled by cancel, and returns
+		// once it has stopped.
+		stop func(sub *Subscription, cancel context.CancelFunc)
+	}{
+		{"Close", func(sub *Subscription, _ context.CancelFunc) {
+			sub.Close()
+		}},
+		{"context cancelled", func(sub *Subscription, cancel context.CancelFunc) {
+			cancel()
+			sub.Wait()
+		}},
+	}
+	for _, tb := range testBrokers(t) {
+		t.Run(tb.name, func(t *testing.T) {
+			conn := tb.connect(t)
+			exchange := declareTestExchange(t, conn, amqp.ExchangeDirect)
+			pub := newTestPublisher(t, conn)
+			for _, c := range cases {
+				t.Run(c.name, func(t *testing.T) {
+					queue := testName("queue")
+					tb.remove(t, queue)
+					started := make(chan struct{})
+					release := make(chan struct{})
+					handlerErr := make(chan error, 1)
+					ctx, cancel := context.WithCancel(context.Background())
+					defer cancel()
+					sub, err := Subscribe(ctx, conn, exchange, queue, "key", SimpleQueueDurable, func(ctx context.Context, _ string) AckType {
+						close(started)
+						<-release
+						handlerErr <- ctx.Err()
+						return Ack
+					}, WithoutMiddleware())
+					if err != nil {
+						t.Fatalf("Subscribe: %v", err)
+					}
+					if err := PublishJSON(context.Background(), pub, exchange, "key", "hello"); err != nil {
+						t.Fatalf("PublishJSON: %v", err)
+					}
+					receive(t, started)
+
+					stopped := make(chan struct{})
+					go func() {
+						c.stop(sub, cancel)
+						close(stopped)
+					}()
+					select {
+					case <-stopped:
+						t.Fatal("subscription stopped while a handler was running")
+					case <-time.After(50 * time.Millisecond):
+					}
+					close(release)
+					receive(t, stopped)
+					if err := receive(t, handlerErr); err != nil {
+						t.Errorf("handler context ended with %v before the handler returned", err)
+					}
+					select {
+					case <-sub.Done():
+					default:
+						t.Error("Done is not closed after the subscription stopped")
+					}
+					// The message was acked rather than requeued
+					if n := queueLen(t, conn, queue); n != 0 {
+						t.Errorf("%d messages left in the queue, want none", n)
+					}
+				})
+			}
+		})
+	}
+}
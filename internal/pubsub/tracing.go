@@ -0,0 +1,122 @@
+package pubsub
+
+import (
+	"context"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/nguyenanhhao221/learn-pub-sub-starter/internal/pubsub"
+
+var (
+	queueKey = attribute.Key("messaging.rabbitmq.queue")
+	ackKey   = attribute.Key("messaging.rabbitmq.ack")
+)
+
+// headerCarrier lets the OpenTelemetry propagator read and write trace
+// context in AMQP headers.
+type headerCarrier amqp.Table
+
+func (c headerCarrier) Get(key string) string {
+	v, _ := c[key].(string)
+	return v
+}
+
+func (c headerCarrier) Set(key, value string) {
+	c[key] = value
+}
+
+func (c headerCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// startPublishSpan starts a producer span for a publish and writes its trace
+// context into headers, so the consumer's span joins the same trace.
+func startPublishSpan(ctx context.Context, exchange, key string, msg amqp.Publishing, headers amqp.Table) (context.Context, trace.Span) {
+	ctx, span := otel.Tracer(tracerName).Start(ctx, "publish "+destination(exchange),
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			semconv.MessagingSystemRabbitmq,
+			semconv.MessagingOperationTypePublish,
+			semconv.MessagingDestinationName(exchange),
+			semconv.MessagingRabbitmqDestinationRoutingKey(key),
+			semconv.MessagingMessageID(msg.MessageId),
+			semconv.MessagingMessageBodySize(len(msg.Body)),
+		),
+	)
+	otel.GetTextMapPropagator().Inject(ctx, headerCarrier(headers))
+	return ctx, span
+}
+
+// startConsumeSpan starts a consumer span for delivery, as a child of the
+// span that published it when the headers carry one.
+func startConsumeSpan(ctx context.Context, queue string, delivery amqp.Delivery) (context.Context, trace.Span) {
+	if delivery.Headers != nil {
+		ctx = otel.GetTextMapPropagator().Extract(ctx, headerCarrier(delivery.Headers))
+	}
+	return otel.Tracer(tracerName).Start(ctx, "process "+queue,
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			semconv.MessagingSystemRabbitmq,
+			semconv.MessagingOperationTypeDeliver,
+			semconv.MessagingDestinationName(delivery.Exchange),
+			semconv.MessagingRabbitmqDestinationRoutingKey(delivery.RoutingKey),
+			semconv.MessagingMessageID(delivery.MessageId),
+			semconv.MessagingRabbitmqMessageDeliveryTag(int(delivery.DeliveryTag)),
+			queueKey.String(queue),
+		),
+	)
+}
+
+// startBatchSpan starts a consumer span for a batch of deliveries, linked to
+// the span that published each of them.
+func startBatchSpan(ctx context.Context, queue string, deliveries []amqp.Delivery) (context.Context, trace.Span) {
+	links := make([]trace.Link, 0, len(deliveries))
+	for _, delivery := range deliveries {
+		if delivery.Headers == nil {
+			continue
+		}
+		producer := otel.GetTextMapPropagator().Extract(ctx, headerCarrier(delivery.Headers))
+		if link := trace.LinkFromContext(producer); link.SpanContext.IsValid() {
+			links = append(links, link)
+		}
+	}
+	return otel.Tracer(tracerName).Start(ctx, "process "+queue,
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithLinks(links...),
+		trace.WithAttributes(
+			semconv.MessagingSystemRabbitmq,
+			semconv.MessagingOperationTypeDeliver,
+			semconv.MessagingBatchMessageCount(len(deliveries)),
+			queueKey.String(queue),
+		),
+	)
+}
+
+// endConsumeSpan records how the delivery was settled and ends span.
+func endConsumeSpan(span trace.Span, ackType AckType, err error) {
+	span.SetAttributes(ackKey.String(ackType.String()))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	} else if ackType != Ack {
+		span.SetStatus(codes.Error, ackType.String())
+	}
+	span.End()
+}
+
+func destination(exchange string) string {
+	if exchange == "" {
+		return "(default)"
+	}
+	return exchange
+}
@@ -0,0 +1,98 @@
+package pubsub
+
+import (
+	"context"
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// recordSpans installs a global tracer provider that records every span
+// until the test ends.
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+	recorder := tracetest.NewSpanRecorder()
+	provider, propagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		otel.SetTracerProvider(provider)
+		otel.SetTextMapPropagator(propagator)
+	})
+	return recorder
+}
+
+func TestConsumeSpanJoinsPublishTrace(t *testing.T) {
+	cases := []struct {
+		ack    AckType
+		status codes.Code
+	}{
+		{Ack, codes.Unset},
+		{NackDiscard, codes.Error},
+	}
+	for _, tb := range testBrokers(t) {
+		t.Run(tb.name, func(t *testing.T) {
+			conn := tb.connect(t)
+			exchange := declareTestExchange(t, conn, amqp.ExchangeDirect)
+			pub := newTestPublisher(t, conn)
+			for _, c := range cases {
+				t.Run(c.ack.String(), func(t *testing.T) {
+					recorder := recordSpans(t)
+					handled := make(chan trace.SpanContext, 1)
+					sub, err := Subscribe(testContext(t), conn, exchange, "", "key", SimpleQueueTransient, func(ctx context.Context, _ string) AckType {
+						handled <- trace.SpanContextFromContext(ctx)
+						return c.ack
+					}, WithoutMiddleware())
+					if err != nil {
+						t.Fatalf("Subscribe: %v", err)
+					}
+					defer sub.Close()
+					if err := PublishJSON(context.Background(), pub, exchange, "key", "hello"); err != nil {
+						t.Fatalf("PublishJSON: %v", err)
+					}
+					handler := receive(t, handled)
+
+					var publish, process sdktrace.ReadOnlySpan
+					eventually(t, "both spans have ended", func() bool {
+						for _, span := range recorder.Ended() {
+							switch span.SpanKind() {
+							case trace.SpanKindProducer:
+								publish = span
+							case trace.SpanKindConsumer:
+								process = span
+							}
+						}
+						return publish != nil && process != nil
+					})
+					if publish.Name() != "publish "+exchange {
+						t.Errorf("publish span is named %q", publish.Name())
+					}
+					if process.Parent().SpanID() != publish.SpanContext().SpanID() {
+						t.Error("process span is not a child of the publish span")
+					}
+					if handler.TraceID() != publish.SpanContext().TraceID() {
+						t.Error("handler context is not in the publish span's trace")
+					}
+					if got := process.Status().Code; got != c.status {
+						t.Errorf("process span status = %v, want %v", got, c.status)
+					}
+					var ack string
+					for _, attr := range process.Attributes() {
+						if attr.Key == ackKey {
+							ack = attr.Value.AsString()
+						}
+					}
+					if ack != c.ack.String() {
+						t.Errorf("process span ack = %q, want %q", ack, c.ack.String())
+					}
+				})
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package pubsub
+
+import (
+	"hash/fnv"
+	"sync"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// defaultPrefetch is the prefetch count of a subscription with one worker.
+const defaultPrefetch = 10
+
+// WithConcurrency runs the handler on n goroutines instead of one. The
+// prefetch count is raised to keep every worker busy. Without
+// WithKeyOrdering, deliveries are handled in no particular order.
+func WithConcurrency(n int) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.concurrency = max(n, 1)
+	}
+}
+
+// WithKeyOrdering makes a concurrent subscription handle deliveries with the
+// same routing key one at a time, in the order they arrived, while different
+// keys still run in parallel. Messages back from a retry queue are ordered by
+// the key they were first published with.
+func WithKeyOrdering() SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.orderedByKey = true
+	}
+}
+
+// prefetchFor returns the prefetch count for a subscription with the given
+// number of workers, so that each has a delivery ready when it finishes one.
+func prefetchFor(workers int) int {
+	return max(defaultPrefetch, 2*workers)
+}
+
+// dispatch hands deliveries to workers goroutines running process, and
+// returns once deliveries is closed and every worker has finished.
+func dispatch(deliveries <-chan amqp.Delivery, workers int, orderedByKey bool, process func(amqp.Delivery)) {
+	var wg sync.WaitGroup
+	if !orderedByKey {
+		for range workers {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for delivery := range deliveries {
+					process(delivery)
+				}
+			}()
+		}
+		wg.Wait()
+		return
+	}
+
+	// Every routing key hashes to one worker, which handles its deliveries
+	// in order.
+	queues := make([]chan amqp.Delivery, workers)
+	for i := range queues {
+		queues[i] = make(chan amqp.Delivery, defaultPrefetch)
+		wg.Add(1)
+		go func(queue <-chan amqp.Delivery) {
+			defer wg.Done()
+			for delivery := range queue {
+				process(delivery)
+			}
+		}(queues[i])
+	}
+	for delivery := range deliveries {
+		// A retried message comes back with the queue name as its key
+		key := delivery.RoutingKey
+		if original, ok := delivery.Headers[OriginalRoutingKeyHeader].(string); ok {
+			key = original
+		}
+		h := fnv.New32a()
+		h.Write([]byte(key))
+		queues[h.Sum32()%uint32(workers)] <- delivery
+	}
+	for _, queue := range queues {
+		close(queue)
+	}
+	wg.Wait()
+}
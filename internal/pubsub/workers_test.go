@@ -0,0 +1,109 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestWithKeyOrdering(t *testing.T) {
+	const perKey = 10
+	keys := []string{"war.alice", "war.bob", "war.carol", "war.dave"}
+	for _, tb := range testBrokers(t) {
+		t.Run(tb.name, func(t *testing.T) {
+			conn := tb.connect(t)
+			exchange := declareTestExchange(t, conn, amqp.ExchangeTopic)
+			pub := newTestPublisher(t, conn)
+			var mu sync.Mutex
+			got := map[string][]int{}
+			done := make(chan struct{}, len(keys)*perKey)
+			sub, err := SubscribeWithMetadata(testContext(t), conn, exchange, "", "war.*", SimpleQueueTransient, func(_ context.Context, i int, meta Metadata) AckType {
+				// Later messages finish sooner, so any reordering shows
+				time.Sleep(time.Duration(perKey-i) * time.Millisecond)
+				mu.Lock()
+				got[meta.RoutingKey] = append(got[meta.RoutingKey], i)
+				mu.Unlock()
+				done <- struct{}{}
+				return Ack
+			}, WithConcurrency(4), WithKeyOrdering(), WithoutMiddleware())
+			if err != nil {
+				t.Fatalf("Subscribe: %v", err)
+			}
+			defer sub.Close()
+
+			for i := 0; i < perKey; i++ {
+				for _, key := range keys {
+					if err := PublishJSON(context.Background(), pub, exchange, key, i); err != nil {
+						t.Fatalf("PublishJSON: %v", err)
+					}
+				}
+			}
+			for range len(keys) * perKey {
+				receive(t, done)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			want := fmt.Sprint([]int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9})
+			for _, key := range keys {
+				if order := fmt.Sprint(got[key]); order != want {
+					t.Errorf("%s handled in order %s, want %s", key, order, want)
+				}
+			}
+		})
+	}
+}
+
+func TestDispatchOrdersRetriesByOriginalKey(t *testing.T) {
+	keys := []string{"war.alice", "war.bob", "war.carol", "war.dave", "war.erin", "war.frank"}
+	cases := []struct {
+		name    string
+		retried bool
+	}{
+		{"first deliveries", false},
+		{"retried deliveries", true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			// Each key has a first delivery followed by one that is either
+			// another first delivery or back from a retry queue, whose
+			// routing key is the queue name
+			deliveries := make(chan amqp.Delivery, 2*len(keys))
+			for _, key := range keys {
+				deliveries <- amqp.Delivery{RoutingKey: key}
+				second := amqp.Delivery{RoutingKey: key}
+				if c.retried {
+					second = amqp.Delivery{RoutingKey: "war", Headers: amqp.Table{OriginalRoutingKeyHeader: key}}
+				}
+				deliveries <- second
+			}
+			close(deliveries)
+
+			var mu sync.Mutex
+			inFlight := map[string]int{}
+			overlapped := map[string]bool{}
+			dispatch(deliveries, 4, true, func(d amqp.Delivery) {
+				key := d.RoutingKey
+				if original, ok := d.Headers[OriginalRoutingKeyHeader].(string); ok {
+					key = original
+				}
+				mu.Lock()
+				inFlight[key]++
+				if inFlight[key] > 1 {
+					overlapped[key] = true
+				}
+				mu.Unlock()
+				time.Sleep(10 * time.Millisecond)
+				mu.Lock()
+				inFlight[key]--
+				mu.Unlock()
+			})
+			for key := range overlapped {
+				t.Errorf("two deliveries for %s were handled at once", key)
+			}
+		})
+	}
+}
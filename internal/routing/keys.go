@@ -0,0 +1,98 @@
+package routing
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/nguyenanhhao221/learn-pub-sub-starter/internal/pubsub"
+)
+
+// Binding patterns that match the keys of every player.
+const (
+	ArmyMovesPattern       = ArmyMovesPrefix + ".*"
+	WarRecognitionsPattern = WarRecognitionsPrefix + ".*"
+	GameLogPattern         = GameLogSlug + ".*"
+)
+
+// Key is a parsed routing key. String returns the key as published.
+type Key interface {
+	String() string
+}
+
+// ArmyMoveKey is the key of a move made by Username.
+type ArmyMoveKey struct {
+	Username string
+}
+
+func (k ArmyMoveKey) String() string {
+	return ArmyMovesPrefix + "." + k.Username
+}
+
+// WarKey is the key of a war recognized by Username, the defender.
+type WarKey struct {
+	Username string
+}
+
+func (k WarKey) String() string {
+	return WarRecognitionsPrefix + "." + k.Username
+}
+
+// GameLogKey is the key of a game log about a war Username started.
+type GameLogKey struct {
+	Username string
+}
+
+func (k GameLogKey) String() string {
+	return GameLogSlug + "." + k.Username
+}
+
+// PauseStateKey is the key of pause and resume messages.
+type PauseStateKey struct{}
+
+func (PauseStateKey) String() string {
+	return PauseKey
+}
+
+// ValidateUsername reports why username cannot be used in a routing key, if
+// it cannot. Dots would split it into several words, and `*` and `#` are
+// wildcards in binding patterns.
+func ValidateUsername(username string) error {
+	if username == "" {
+		return fmt.Errorf("username must not be empty")
+	}
+	if i := strings.IndexAny(username, ".*#"); i >= 0 {
+		return fmt.Errorf("username %q must not contain %q", username, username[i])
+	}
+	return nil
+}
+
+// ParseKey parses a routing key published by Peril into an ArmyMoveKey,
+// WarKey, GameLogKey or PauseStateKey.
+func ParseKey(key string) (Key, error) {
+	if key == PauseKey {
+		return PauseStateKey{}, nil
+	}
+	prefix, username, ok := strings.Cut(key, ".")
+	if !ok {
+		return nil, fmt.Errorf("unknown routing key %q", key)
+	}
+	if err := ValidateUsername(username); err != nil {
+		return nil, fmt.Errorf("routing key %q: %w", key, err)
+	}
+	switch prefix {
+	case ArmyMovesPrefix:
+		return ArmyMoveKey{Username: username}, nil
+	case WarRecognitionsPrefix:
+		return WarKey{Username: username}, nil
+	case GameLogSlug:
+		return GameLogKey{Username: username}, nil
+	}
+	return nil, fmt.Errorf("unknown routing key %q", key)
+}
+
+// MatchTopic reports whether key matches a topic binding pattern, where `*`
+// matches exactly one word and `#` matches zero or more words, as a topic
+// exchange would route it.
+func MatchTopic(pattern, key string) bool {
+	return pubsub.MatchTopic(pattern, key)
+}
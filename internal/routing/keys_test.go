@@ -0,0 +1,58 @@
+package routing
+
+import "testing"
+
+func TestParseKey(t *testing.T) {
+	cases := []struct {
+		key     string
+		want    Key
+		wantErr bool
+	}{
+		{"pause", PauseStateKey{}, false},
+		{"army_moves.alice", ArmyMoveKey{Username: "alice"}, false},
+		{"war.alice", WarKey{Username: "alice"}, false},
+		{"game_logs.alice", GameLogKey{Username: "alice"}, false},
+		{"army_moves", nil, true},
+		{"army_moves.", nil, true},
+		{"army_moves.alice.bob", nil, true},
+		{"army_moves.*", nil, true},
+		{"war.#", nil, true},
+		{"pause.alice", nil, true},
+		{"unknown.alice", nil, true},
+		{"", nil, true},
+	}
+	for _, c := range cases {
+		got, err := ParseKey(c.key)
+		if (err != nil) != c.wantErr {
+			t.Errorf("ParseKey(%q) error = %v, want error %v", c.key, err, c.wantErr)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("ParseKey(%q) = %#v, want %#v", c.key, got, c.want)
+		}
+		if got != nil && got.String() != c.key {
+			t.Errorf("ParseKey(%q).String() = %q", c.key, got.String())
+		}
+	}
+}
+
+func TestKeysMatchPatterns(t *testing.T) {
+	cases := []struct {
+		pattern string
+		key     Key
+		want    bool
+	}{
+		{ArmyMovesPattern, ArmyMoveKey{Username: "alice"}, true},
+		{ArmyMovesPattern, WarKey{Username: "alice"}, false},
+		{WarRecognitionsPattern, WarKey{Username: "alice"}, true},
+		{WarRecognitionsPattern, GameLogKey{Username: "alice"}, false},
+		{GameLogPattern, GameLogKey{Username: "alice"}, true},
+		{GameLogPattern, PauseStateKey{}, false},
+		{PauseKey, PauseStateKey{}, true},
+	}
+	for _, c := range cases {
+		if got := MatchTopic(c.pattern, c.key.String()); got != c.want {
+			t.Errorf("MatchTopic(%q, %q) = %v, want %v", c.pattern, c.key, got, c.want)
+		}
+	}
+}
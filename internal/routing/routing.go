@@ -1,5 +1,7 @@
 package routing
 
+import "github.com/nguyenanhhao221/learn-pub-sub-starter/internal/pubsub"
+
 const (
 	ArmyMovesPrefix = "army_moves"
 
@@ -13,4 +15,35 @@ const (
 const (
 	ExchangePerilDirect = "peril_direct"
 	ExchangePerilTopic  = "peril_topic"
+	// ExchangePerilDLX is where queues dead-letter to unless the topology
+	// says otherwise.
+	ExchangePerilDLX = pubsub.DeadLetterExchange
+)
+
+// Queues shared by every client, and the server's own.
+const (
+	WarQueue     = WarRecognitionsPrefix
+	GameLogQueue = GameLogSlug
+	// GameLogStreamQueue keeps every game log, unlike GameLogQueue, which
+	// the server drains, so past logs can be replayed.
+	GameLogStreamQueue    = GameLogSlug + "_stream"
+	ArmyMovesMetricsQueue = ArmyMovesPrefix + "_metrics"
+	WarMetricsQueue       = WarRecognitionsPrefix + "_metrics"
 )
+
+// WarMaxPriority is the x-max-priority of WarQueue, as declared in
+// topology.yaml. A war recognition's priority is the number of units that
+// moved, up to this.
+const WarMaxPriority = 10
+
+// PauseQueue is the queue on which username receives pause and resume
+// messages.
+func PauseQueue(username string) string {
+	return PauseKey + "." + username
+}
+
+// ArmyMovesQueue is the queue on which username receives every player's
+// moves.
+func ArmyMovesQueue(username string) string {
+	return ArmyMovesPrefix + "." + username
+}
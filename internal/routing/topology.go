@@ -0,0 +1,429 @@
+package routing
+
+import (
+	_ "embed"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+
+	"github.com/nguyenanhhao221/learn-pub-sub-starter/internal/pubsub"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"gopkg.in/yaml.v3"
+)
+
+//go:embed topology.yaml
+var defaultTopology []byte
+
+// Topology describes the exchanges, queues and bindings a deployment needs.
+// It is read from YAML, or JSON, which is valid YAML. DeadLetterExchange is
+// where the queues that clients declare for themselves dead-letter to.
+type Topology struct {
+	DeadLetterExchange string         `yaml:"dead_letter_exchange" json:"dead_letter_exchange"`
+	Exchanges          []ExchangeSpec `yaml:"exchanges" json:"exchanges"`
+	Queues             []QueueSpec    `yaml:"queues" json:"queues"`
+	Bindings           []BindingSpec  `yaml:"bindings" json:"bindings"`
+}
+
+type ExchangeSpec struct {
+	Name       string         `yaml:"name" json:"name"`
+	Type       string         `yaml:"type" json:"type"`
+	Durable    bool           `yaml:"durable" json:"durable"`
+	AutoDelete bool           `yaml:"auto_delete" json:"auto_delete"`
+	Internal   bool           `yaml:"internal" json:"internal"`
+	Arguments  map[string]any `yaml:"arguments" json:"arguments"`
+}
+
+// QueueSpec describes a queue. DeadLetterExchange and DeadLetterRoutingKey
+// are shorthands for the x-dead-letter-* arguments.
+type QueueSpec struct {
+	Name                 string         `yaml:"name" json:"name"`
+	Durable              bool           `yaml:"durable" json:"durable"`
+	AutoDelete           bool           `yaml:"auto_delete" json:"auto_delete"`
+	Exclusive            bool           `yaml:"exclusive" json:"exclusive"`
+	DeadLetterExchange   string         `yaml:"dead_letter_exchange" json:"dead_letter_exchange"`
+	DeadLetterRoutingKey string         `yaml:"dead_letter_routing_key" json:"dead_letter_routing_key"`
+	Arguments            map[string]any `yaml:"arguments" json:"arguments"`
+}
+
+type BindingSpec struct {
+	Exchange  string         `yaml:"exchange" json:"exchange"`
+	Queue     string         `yaml:"queue" json:"queue"`
+	Key       string         `yaml:"key" json:"key"`
+	Arguments map[string]any `yaml:"arguments" json:"arguments"`
+}
+
+// Declarer declares topology on a broker. pubsub.Channel and *amqp.Channel
+// implement it.
+type Declarer interface {
+	ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error
+	QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error
+}
+
+// LoadTopology reads and validates the topology in the file at path, or the
+// built-in Peril topology if path is empty.
+func LoadTopology(path string) (Topology, error) {
+	if path == "" {
+		return ParseTopology(defaultTopology)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Topology{}, fmt.Errorf("could not read topology: %w", err)
+	}
+	t, err := ParseTopology(data)
+	if err != nil {
+		return Topology{}, fmt.Errorf("%s: %w", path, err)
+	}
+	return t, nil
+}
+
+// ParseTopology decodes a YAML or JSON topology and validates it.
+func ParseTopology(data []byte) (Topology, error) {
+	var t Topology
+	if err := yaml.Unmarshal(data, &t); err != nil {
+		return Topology{}, fmt.Errorf("could not parse topology: %w", err)
+	}
+	if err := t.Validate(); err != nil {
+		return Topology{}, err
+	}
+	return t, nil
+}
+
+// Validate checks that names are present and unique, exchange types are
+// known, and that bindings and dead-letter exchanges refer to declared
+// exchanges and queues. Exchanges built into RabbitMQ may be referred to
+// without being declared.
+func (t Topology) Validate() error {
+	var errs []error
+	exchanges := map[string]ExchangeSpec{}
+	for _, e := range t.Exchanges {
+		switch {
+		case e.Name == "":
+			errs = append(errs, errors.New("exchange without a name"))
+		case builtinExchange(e.Name):
+			errs = append(errs, fmt.Errorf("exchange %q: the amq. prefix is reserved", e.Name))
+		case exchanges[e.Name].Name != "":
+			errs = append(errs, fmt.Errorf("exchange %q declared twice", e.Name))
+		}
+		switch e.Type {
+		case amqp.ExchangeDirect, amqp.ExchangeFanout, amqp.ExchangeTopic, amqp.ExchangeHeaders:
+		default:
+			if !strings.HasPrefix(e.Type, "x-") {
+				errs = append(errs, fmt.Errorf("exchange %q: unknown type %q", e.Name, e.Type))
+			}
+		}
+		exchanges[e.Name] = e
+	}
+	knownExchange := func(name string) bool {
+		_, ok := exchanges[name]
+		return ok || builtinExchange(name)
+	}
+
+	if t.DeadLetterExchange != "" && !knownExchange(t.DeadLetterExchange) {
+		errs = append(errs, fmt.Errorf("dead-letter exchange %q is not declared", t.DeadLetterExchange))
+	}
+
+	queues := map[string]bool{}
+	for _, q := range t.Queues {
+		switch {
+		case q.Name == "":
+			errs = append(errs, errors.New("queue without a name"))
+		case queues[q.Name]:
+			errs = append(errs, fmt.Errorf("queue %q declared twice", q.Name))
+		}
+		if q.DeadLetterExchange != "" && !knownExchange(q.DeadLetterExchange) {
+			errs = append(errs, fmt.Errorf("queue %q: dead-letter exchange %q is not declared", q.Name, q.DeadLetterExchange))
+		}
+		queues[q.Name] = true
+	}
+
+	for _, b := range t.Bindings {
+		if !knownExchange(b.Exchange) {
+			errs = append(errs, fmt.Errorf("binding of %q: exchange %q is not declared", b.Queue, b.Exchange))
+		}
+		if !queues[b.Queue] {
+			errs = append(errs, fmt.Errorf("binding to %q: queue is not declared", b.Queue))
+		}
+		if exchanges[b.Exchange].Type == amqp.ExchangeTopic && !validTopicPattern(b.Key) {
+			errs = append(errs, fmt.Errorf("binding of %q to %q: invalid topic pattern %q", b.Queue, b.Exchange, b.Key))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// builtinExchange reports whether name is the default exchange or one of
+// the amq.* exchanges every broker has.
+func builtinExchange(name string) bool {
+	return name == "" || strings.HasPrefix(name, "amq.")
+}
+
+// validTopicPattern reports whether every word of a topic binding key is
+// either a literal or a lone `*` or `#`.
+func validTopicPattern(pattern string) bool {
+	for _, word := range strings.Split(pattern, ".") {
+		if word != "*" && word != "#" && strings.ContainsAny(word, "*#") {
+			return false
+		}
+	}
+	return true
+}
+
+// Apply declares everything in the topology: exchanges first, then queues,
+// then bindings. Declaring what already exists with the same settings does
+// nothing, so Apply is safe to run at every startup; a queue or exchange
+// that exists with different settings makes it fail.
+func (t Topology) Apply(d Declarer) error {
+	for _, e := range t.Exchanges {
+		if err := d.ExchangeDeclare(e.Name, e.Type, e.Durable, e.AutoDelete, e.Internal, false, table(e.Arguments)); err != nil {
+			return fmt.Errorf("could not declare exchange %q: %w", e.Name, err)
+		}
+	}
+	for _, q := range t.Queues {
+		if _, err := d.QueueDeclare(q.Name, q.Durable, q.AutoDelete, q.Exclusive, false, q.args()); err != nil {
+			return fmt.Errorf("could not declare queue %q: %w", q.Name, err)
+		}
+	}
+	for _, b := range t.Bindings {
+		if err := d.QueueBind(b.Queue, b.Key, b.Exchange, false, table(b.Arguments)); err != nil {
+			return fmt.Errorf("could not bind queue %q to %q: %w", b.Queue, b.Exchange, err)
+		}
+	}
+	return nil
+}
+
+// QueueOptions returns the options that declare queue the way the topology
+// does: with the dead-letter exchange of its QueueSpec if it declares the
+// queue, or with the topology's DeadLetterExchange otherwise. An empty one
+// opts out of pubsub.DeadLetterExchange. Pass them to DeclareAndBind,
+// or to a subscription with pubsub.WithQueueOptions, so that a queue the
+// topology also declares is declared with the same arguments.
+func (t Topology) QueueOptions(queue string) []pubsub.QueueOption {
+	dlx := t.DeadLetterExchange
+	for _, q := range t.Queues {
+		if q.Name == queue {
+			dlx = q.DeadLetterExchange
+			break
+		}
+	}
+	return []pubsub.QueueOption{pubsub.WithDeadLetterExchange(dlx)}
+}
+
+// DeadLetterQueues returns the queues bound to the topology's
+// DeadLetterExchange, where dead-lettered messages are kept.
+func (t Topology) DeadLetterQueues() []string {
+	var queues []string
+	for _, b := range t.Bindings {
+		if t.DeadLetterExchange != "" && b.Exchange == t.DeadLetterExchange {
+			queues = append(queues, b.Queue)
+		}
+	}
+	return queues
+}
+
+// ApplyTopologyFile loads the topology in the file at path, or the built-in
+// one if path is empty, and applies it through a channel of broker. On a
+// pubsub.ManagedBroker the topology is then declared again on reconnect.
+func ApplyTopologyFile(broker pubsub.Broker, path string) (Topology, error) {
+	t, err := LoadTopology(path)
+	if err != nil {
+		return Topology{}, err
+	}
+	ch, err := broker.Channel()
+	if err != nil {
+		return Topology{}, err
+	}
+	defer ch.Close()
+	if err := t.Apply(ch); err != nil {
+		return Topology{}, err
+	}
+	return t, nil
+}
+
+// args returns the queue's arguments including the dead-letter shorthands.
+func (q QueueSpec) args() amqp.Table {
+	args := table(q.Arguments)
+	if q.DeadLetterExchange != "" || q.DeadLetterRoutingKey != "" {
+		if args == nil {
+			args = amqp.Table{}
+		}
+		if q.DeadLetterExchange != "" {
+			args["x-dead-letter-exchange"] = q.DeadLetterExchange
+		}
+		if q.DeadLetterRoutingKey != "" {
+			args["x-dead-letter-routing-key"] = q.DeadLetterRoutingKey
+		}
+	}
+	return args
+}
+
+// table converts decoded arguments to an amqp.Table, with every number
+// that has no fractional part as an int64 so it is sent as an integer.
+func table(m map[string]any) amqp.Table {
+	if len(m) == 0 {
+		return nil
+	}
+	t := make(amqp.Table, len(m))
+	for k, v := range m {
+		t[k] = normalizeArg(v)
+	}
+	return t
+}
+
+func normalizeArg(v any) any {
+	switch n := v.(type) {
+	case int:
+		return int64(n)
+	case int8:
+		return int64(n)
+	case int16:
+		return int64(n)
+	case int32:
+		return int64(n)
+	case uint8:
+		return int64(n)
+	case uint16:
+		return int64(n)
+	case uint32:
+		return int64(n)
+	case float32:
+		return normalizeArg(float64(n))
+	case float64:
+		if n == float64(int64(n)) {
+			return int64(n)
+		}
+	}
+	return v
+}
+
+// Difference is one way a broker's actual topology differs from the wanted
+// one.
+type Difference struct {
+	// Kind is "exchange", "queue" or "binding".
+	Kind string
+	Name string
+	// Change is "missing", "differs" or "unexpected".
+	Change string
+	Detail string
+}
+
+func (d Difference) String() string {
+	s := fmt.Sprintf("%s %s %s", d.Change, d.Kind, d.Name)
+	if d.Detail != "" {
+		s += ": " + d.Detail
+	}
+	return s
+}
+
+// Diff compares the actual topology of a broker with t. Besides what is
+// missing or declared differently, it reports as unexpected the durable,
+// non-exclusive queues and the exchanges t does not mention, and any other
+// binding to a queue t declares. Built-in exchanges, transient queues and
+// the bindings of the default exchange are left out, since clients declare
+// those for themselves.
+func (t Topology) Diff(actual Topology) []Difference {
+	var diffs []Difference
+
+	actualExchanges := map[string]ExchangeSpec{}
+	for _, e := range actual.Exchanges {
+		actualExchanges[e.Name] = e
+	}
+	wantExchanges := map[string]bool{}
+	for _, want := range t.Exchanges {
+		wantExchanges[want.Name] = true
+		got, ok := actualExchanges[want.Name]
+		if !ok {
+			diffs = append(diffs, Difference{Kind: "exchange", Name: want.Name, Change: "missing"})
+			continue
+		}
+		var detail []string
+		detail = compare(detail, "type", want.Type, got.Type)
+		detail = compare(detail, "durable", want.Durable, got.Durable)
+		detail = compare(detail, "auto_delete", want.AutoDelete, got.AutoDelete)
+		detail = compare(detail, "internal", want.Internal, got.Internal)
+		detail = compareArgs(detail, table(want.Arguments), table(got.Arguments))
+		if len(detail) > 0 {
+			diffs = append(diffs, Difference{Kind: "exchange", Name: want.Name, Change: "differs", Detail: strings.Join(detail, ", ")})
+		}
+	}
+	for _, got := range actual.Exchanges {
+		if !wantExchanges[got.Name] && !builtinExchange(got.Name) {
+			diffs = append(diffs, Difference{Kind: "exchange", Name: got.Name, Change: "unexpected"})
+		}
+	}
+
+	actualQueues := map[string]QueueSpec{}
+	for _, q := range actual.Queues {
+		actualQueues[q.Name] = q
+	}
+	wantQueues := map[string]bool{}
+	for _, want := range t.Queues {
+		wantQueues[want.Name] = true
+		got, ok := actualQueues[want.Name]
+		if !ok {
+			diffs = append(diffs, Difference{Kind: "queue", Name: want.Name, Change: "missing"})
+			continue
+		}
+		var detail []string
+		detail = compare(detail, "durable", want.Durable, got.Durable)
+		detail = compare(detail, "auto_delete", want.AutoDelete, got.AutoDelete)
+		detail = compare(detail, "exclusive", want.Exclusive, got.Exclusive)
+		detail = compareArgs(detail, want.args(), got.args())
+		if len(detail) > 0 {
+			diffs = append(diffs, Difference{Kind: "queue", Name: want.Name, Change: "differs", Detail: strings.Join(detail, ", ")})
+		}
+	}
+	for _, got := range actual.Queues {
+		if !wantQueues[got.Name] && got.Durable && !got.Exclusive && !got.AutoDelete {
+			diffs = append(diffs, Difference{Kind: "queue", Name: got.Name, Change: "unexpected"})
+		}
+	}
+
+	wantBindings := map[string]bool{}
+	for _, want := range t.Bindings {
+		wantBindings[want.String()] = true
+	}
+	actualBindings := map[string]bool{}
+	for _, got := range actual.Bindings {
+		actualBindings[got.String()] = true
+		if !wantBindings[got.String()] && got.Exchange != "" && wantQueues[got.Queue] {
+			diffs = append(diffs, Difference{Kind: "binding", Name: got.String(), Change: "unexpected"})
+		}
+	}
+	for _, want := range t.Bindings {
+		if !actualBindings[want.String()] {
+			diffs = append(diffs, Difference{Kind: "binding", Name: want.String(), Change: "missing"})
+		}
+	}
+	return diffs
+}
+
+func (b BindingSpec) String() string {
+	return fmt.Sprintf("%s -> %s (%q)", b.Exchange, b.Queue, b.Key)
+}
+
+func compare[T comparable](detail []string, field string, want, got T) []string {
+	if want != got {
+		detail = append(detail, fmt.Sprintf("%s is %v, want %v", field, got, want))
+	}
+	return detail
+}
+
+func compareArgs(detail []string, want, got amqp.Table) []string {
+	for k, w := range want {
+		g, ok := got[k]
+		switch {
+		case !ok:
+			detail = append(detail, fmt.Sprintf("%s is not set, want %v", k, w))
+		case !reflect.DeepEqual(w, normalizeArg(g)):
+			detail = append(detail, fmt.Sprintf("%s is %v, want %v", k, g, w))
+		}
+	}
+	for k, g := range got {
+		if _, ok := want[k]; !ok {
+			detail = append(detail, fmt.Sprintf("%s is %v, want it unset", k, g))
+		}
+	}
+	return detail
+}
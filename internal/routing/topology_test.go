@@ -0,0 +1,272 @@
+package routing
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nguyenanhhao221/learn-pub-sub-starter/internal/pubsub"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// amqpURLEnv names the variable holding the URL of a RabbitMQ server to run
+// the tests against as well as against a MemoryBroker.
+const amqpURLEnv = "PERIL_TEST_AMQP_URL"
+
+// testBrokers returns a connection to a fresh MemoryBroker, and to the
+// RabbitMQ server named by amqpURLEnv if it is set, by name.
+func testBrokers(t *testing.T) map[string]func(t *testing.T) pubsub.Broker {
+	brokers := map[string]func(t *testing.T) pubsub.Broker{
+		"memory": func(t *testing.T) pubsub.Broker {
+			conn := pubsub.NewMemoryBroker().Connect()
+			t.Cleanup(func() { conn.Close() })
+			return conn
+		},
+	}
+	if url := os.Getenv(amqpURLEnv); url != "" {
+		brokers["rabbitmq"] = func(t *testing.T) pubsub.Broker {
+			conn, err := amqp.Dial(url)
+			if err != nil {
+				t.Skipf("could not connect to %s: %v", url, err)
+			}
+			broker := pubsub.NewAMQPBroker(conn)
+			t.Cleanup(func() { broker.Close() })
+			return broker
+		}
+	}
+	return brokers
+}
+
+func TestParseTopology(t *testing.T) {
+	cases := []struct {
+		name    string
+		yaml    string
+		wantErr string
+	}{
+		{"built in", string(defaultTopology), ""},
+		{"undeclared dead-letter exchange", `
+dead_letter_exchange: dlx
+`, `dead-letter exchange "dlx" is not declared`},
+		{"undeclared queue dead-letter exchange", `
+queues:
+  - name: q
+    dead_letter_exchange: dlx
+`, `queue "q": dead-letter exchange "dlx" is not declared`},
+		{"binding to undeclared queue", `
+exchanges:
+  - {name: x, type: topic}
+bindings:
+  - {exchange: x, queue: q, key: a.*}
+`, `binding to "q": queue is not declared`},
+		{"invalid topic pattern", `
+exchanges:
+  - {name: x, type: topic}
+queues:
+  - name: q
+bindings:
+  - {exchange: x, queue: q, key: a.b*}
+`, `invalid topic pattern "a.b*"`},
+		{"unknown exchange type", `
+exchanges:
+  - {name: x, type: round-robin}
+`, `unknown type "round-robin"`},
+		{"reserved exchange name", `
+exchanges:
+  - {name: amq.mine, type: direct}
+`, "the amq. prefix is reserved"},
+		{"queue declared twice", `
+queues:
+  - name: q
+  - name: q
+`, `queue "q" declared twice`},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := ParseTopology([]byte(c.yaml))
+			switch {
+			case c.wantErr == "" && err != nil:
+				t.Errorf("ParseTopology: %v", err)
+			case c.wantErr != "" && (err == nil || !strings.Contains(err.Error(), c.wantErr)):
+				t.Errorf("ParseTopology error = %v, want it to mention %q", err, c.wantErr)
+			}
+		})
+	}
+}
+
+// applyWithoutStreams applies topology to conn, a MemoryBroker, leaving out
+// the stream queues it cannot declare.
+func applyWithoutStreams(t *testing.T, conn pubsub.Broker, topology Topology) {
+	t.Helper()
+	streams := map[string]bool{}
+	var queues []QueueSpec
+	for _, q := range topology.Queues {
+		if q.Arguments["x-queue-type"] == "stream" {
+			streams[q.Name] = true
+			continue
+		}
+		queues = append(queues, q)
+	}
+	var bindings []BindingSpec
+	for _, b := range topology.Bindings {
+		if !streams[b.Queue] {
+			bindings = append(bindings, b)
+		}
+	}
+	topology.Queues, topology.Bindings = queues, bindings
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatalf("Channel: %v", err)
+	}
+	defer ch.Close()
+	if err := topology.Apply(ch); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+}
+
+func TestTopologyQueueOptions(t *testing.T) {
+	topology, err := LoadTopology("")
+	if err != nil {
+		t.Fatalf("LoadTopology: %v", err)
+	}
+	if got := topology.DeadLetterQueues(); len(got) != 1 || got[0] != "peril_dlq" {
+		t.Errorf("DeadLetterQueues = %v, want [peril_dlq]", got)
+	}
+	conn := testBrokers(t)["memory"](t)
+	applyWithoutStreams(t, conn, topology)
+	// The shared queues, declared the way the server and clients declare
+	// them; the broker refuses a declaration whose arguments differ
+	cases := []struct {
+		queue     string
+		queueType pubsub.SimpleQueueType
+		opts      []pubsub.QueueOption
+	}{
+		// With a dead-letter exchange
+		{WarQueue, pubsub.SimpleQueueDurable, []pubsub.QueueOption{pubsub.WithMaxPriority(WarMaxPriority)}},
+		{GameLogQueue, pubsub.SimpleQueueDurable, nil},
+		// Without one
+		{"peril_dlq", pubsub.SimpleQueueDurable, nil},
+	}
+	for _, c := range cases {
+		t.Run(c.queue, func(t *testing.T) {
+			ch, _, err := pubsub.DeclareAndBind(conn, ExchangePerilTopic, c.queue, c.queue+".*", c.queueType, append(topology.QueueOptions(c.queue), c.opts...)...)
+			if err != nil {
+				t.Fatalf("DeclareAndBind: %v", err)
+			}
+			ch.Close()
+		})
+	}
+}
+
+// TestDefaultDeadLetterExchange checks that a queue declared without
+// options dead-letters to ExchangePerilDLX. It uses the built-in topology,
+// so it only runs against the in-memory broker.
+func TestDefaultDeadLetterExchange(t *testing.T) {
+	topology, err := LoadTopology("")
+	if err != nil {
+		t.Fatalf("LoadTopology: %v", err)
+	}
+	conn := testBrokers(t)["memory"](t)
+	applyWithoutStreams(t, conn, topology)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sub, err := pubsub.SubscribeJSON(ctx, conn, ExchangePerilTopic, ArmyMovesQueue("alice"), ArmyMovesPrefix+".*", pubsub.SimpleQueueTransient, func(context.Context, string) pubsub.AckType {
+		return pubsub.NackDiscard
+	}, pubsub.WithoutMiddleware())
+	if err != nil {
+		t.Fatalf("SubscribeJSON: %v", err)
+	}
+	defer sub.Close()
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatalf("Channel: %v", err)
+	}
+	defer ch.Close()
+	if err := pubsub.PublishJSON(ctx, ch, ExchangePerilTopic, ArmyMoveKey{Username: "bob"}.String(), "hello"); err != nil {
+		t.Fatalf("PublishJSON: %v", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		d, ok, err := ch.Get("peril_dlq", true)
+		if err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+		if ok {
+			if d.Exchange != ExchangePerilDLX {
+				t.Errorf("dead-lettered through %q, want %q", d.Exchange, ExchangePerilDLX)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the rejected message was not dead-lettered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestApplyTopologyDeadLetters(t *testing.T) {
+	for name, connect := range testBrokers(t) {
+		t.Run(name, func(t *testing.T) {
+			conn := connect(t)
+			// Unique names, so a shared server is not disturbed; the
+			// exchanges and queues go away with the connection
+			suffix := fmt.Sprint(time.Now().UnixNano())
+			dlx, dlq, exchange, queue := "peril_test.dlx."+suffix, "peril_test.dlq."+suffix, "peril_test.topic."+suffix, "peril_test.war."+suffix
+			topology, err := ParseTopology([]byte(fmt.Sprintf(`
+dead_letter_exchange: %[1]s
+exchanges:
+  - {name: %[1]s, type: fanout, auto_delete: true}
+  - {name: %[3]s, type: topic, auto_delete: true}
+queues:
+  - {name: %[2]s, exclusive: true}
+bindings:
+  - {exchange: %[1]s, queue: %[2]s}
+`, dlx, dlq, exchange)))
+			if err != nil {
+				t.Fatalf("ParseTopology: %v", err)
+			}
+			ch, err := conn.Channel()
+			if err != nil {
+				t.Fatalf("Channel: %v", err)
+			}
+			defer ch.Close()
+			if err := topology.Apply(ch); err != nil {
+				t.Fatalf("Apply: %v", err)
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			sub, err := pubsub.SubscribeJSON(ctx, conn, exchange, queue, WarRecognitionsPattern, pubsub.SimpleQueueTransient, func(context.Context, string) pubsub.AckType {
+				return pubsub.NackDiscard
+			}, pubsub.WithQueueOptions(topology.QueueOptions(queue)...), pubsub.WithoutMiddleware())
+			if err != nil {
+				t.Fatalf("SubscribeJSON: %v", err)
+			}
+			defer sub.Close()
+			if err := pubsub.PublishJSON(ctx, ch, exchange, WarKey{Username: "alice"}.String(), "hello"); err != nil {
+				t.Fatalf("PublishJSON: %v", err)
+			}
+
+			deadline := time.Now().Add(5 * time.Second)
+			for {
+				d, ok, err := ch.Get(dlq, true)
+				if err != nil {
+					t.Fatalf("Get: %v", err)
+				}
+				if ok {
+					if d.RoutingKey != "war.alice" {
+						t.Errorf("dead-lettered key = %q, want war.alice", d.RoutingKey)
+					}
+					return
+				}
+				if time.Now().After(deadline) {
+					t.Fatal("the rejected message was not dead-lettered")
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		})
+	}
+}